@@ -0,0 +1,283 @@
+package balancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Config 负载均衡配置，通过服务配置传入，如
+// {"loadBalancingConfig": [{"round_robin": {"version": {"min": "20190828001"}}}]}
+type Config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	Version    VersionConstraint `json:"version"`              // 版本约束
+	HashHeader string            `json:"hashHeader,omitempty"` // ring_hash从此metadata中获取hash key，为空时使用DefaultHashHeader
+	Locality   LocalityConfig    `json:"locality"`             // zone_aware的本地位置和溢出阈值
+	Outlier    OutlierConfig     `json:"outlierDetection"`     // 异常实例检测
+	Breaker    BreakerConfig     `json:"circuitBreaker"`       // 实例熔断
+}
+
+// configHolder 保存单个grpc.ClientConn的负载均衡配置、解析器给出的全部地址、异常实例检测以及使用中的熔断器
+type configHolder struct {
+	breakerSeq  int64  // 使用中的熔断器状态变化时递增，atomic访问，放在第一个保证64位对齐
+	target      string // grpc.ClientConn的目标地址
+	lock        sync.Mutex
+	config      Config
+	addrs       []resolver.Address
+	outlier     *outlierDetector
+	breakerKeys []string
+	closers     []func()
+	rebuilder   *pickerRebuilder
+}
+
+// set 保存配置，返回配置是否变化
+func (h *configHolder) set(c Config) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	changed := !reflect.DeepEqual(h.config, c)
+	h.config = c
+
+	return changed
+}
+
+func (h *configHolder) get() Config {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.config
+}
+
+// setAddresses 保存解析器给出的地址，返回地址是否变化
+func (h *configHolder) setAddresses(addrs []resolver.Address) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	changed := !reflect.DeepEqual(h.addrs, addrs)
+	h.addrs = addrs
+
+	return changed
+}
+
+// rebuild 用最近一次的就绪连接重新生成picker，在配置、地址或分流策略变化而连接状态没有变化时使用
+func (h *configHolder) rebuild() {
+	if h.rebuilder != nil {
+		h.rebuilder.rebuild()
+	}
+}
+
+// useBreakers 切换使用中的熔断器，先引用新的再释放旧的，保留仍在使用的熔断器状态
+func (h *configHolder) useBreakers(infos []subConnInfo, config BreakerConfig) {
+	breakers.acquire(infos, config, h)
+
+	keys := make([]string, 0, len(infos))
+	for _, info := range infos {
+		keys = append(keys, info.breakerKey())
+	}
+
+	h.lock.Lock()
+	old := h.breakerKeys
+	h.breakerKeys = keys
+	h.lock.Unlock()
+
+	breakers.release(old, h)
+}
+
+// onClose 增加balancer关闭时的回调
+func (h *configHolder) onClose(f func()) {
+	h.lock.Lock()
+	h.closers = append(h.closers, f)
+	h.lock.Unlock()
+}
+
+// close 释放使用中的熔断器并调用关闭回调
+func (h *configHolder) close() {
+	h.useBreakers(nil, BreakerConfig{})
+
+	h.lock.Lock()
+	closers := h.closers
+	h.closers = nil
+	h.lock.Unlock()
+
+	for _, f := range closers {
+		f()
+	}
+}
+
+// addresses 解析器给出的全部地址，包括尚未就绪的
+func (h *configHolder) addresses() []resolver.Address {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.addrs
+}
+
+// configBuilder 支持服务配置的负载均衡构建器，每个grpc.ClientConn使用独立的PickerBuilder
+type configBuilder struct {
+	name             string
+	newPickerBuilder func(h *configHolder) base.PickerBuilder
+}
+
+func newConfigBuilder(name string, newPickerBuilder func(h *configHolder) base.PickerBuilder) balancer.Builder {
+	return &configBuilder{name: name, newPickerBuilder: newPickerBuilder}
+}
+
+func (b *configBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	h := &configHolder{target: cc.Target(), outlier: newOutlierDetector()}
+	r := &pickerRebuilder{ClientConn: cc}
+	r.pb = b.newPickerBuilder(h)
+	h.rebuilder = r
+	bb := base.NewBalancerBuilderWithConfig(b.name, r, base.Config{HealthCheck: true})
+
+	return &configBalancer{Balancer: bb.Build(r, opts), holder: h}
+}
+
+func (b *configBuilder) Name() string {
+	return b.name
+}
+
+// ParseConfig 解析服务配置中的负载均衡配置
+func (b *configBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	var c Config
+	err := json.Unmarshal(js, &c)
+	if err != nil {
+		return nil, fmt.Errorf("%s parse config error = %s", b.name, err)
+	}
+
+	err = c.Version.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s parse config error = %s", b.name, err)
+	}
+
+	err = c.Locality.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s parse config error = %s", b.name, err)
+	}
+
+	err = c.Outlier.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s parse config error = %s", b.name, err)
+	}
+
+	err = c.Breaker.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s parse config error = %s", b.name, err)
+	}
+
+	return &c, nil
+}
+
+// configBalancer 在base balancer更新地址前保存配置，使生成的picker使用最新配置
+type configBalancer struct {
+	balancer.Balancer
+	holder *configHolder
+}
+
+// UpdateClientConnState base balancer只在连接状态变化时重新生成picker，配置或地址变化时在其更新连接后主动重新生成
+func (b *configBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	c := Config{}
+	if config, ok := s.BalancerConfig.(*Config); ok && config != nil {
+		c = *config
+	}
+	configChanged := b.holder.set(c)
+	addrsChanged := b.holder.setAddresses(s.ResolverState.Addresses)
+
+	var err error
+	if v2, ok := b.Balancer.(balancer.V2Balancer); ok {
+		err = v2.UpdateClientConnState(s)
+	} else {
+		b.Balancer.HandleResolvedAddrs(s.ResolverState.Addresses, nil)
+	}
+
+	if configChanged || addrsChanged {
+		b.holder.rebuild()
+	}
+
+	return err
+}
+
+// Close 释放使用中的熔断器及其他按grpc.ClientConn引用的资源
+func (b *configBalancer) Close() {
+	b.holder.close()
+	b.Balancer.Close()
+}
+
+func (b *configBalancer) ResolverError(err error) {
+	if v2, ok := b.Balancer.(balancer.V2Balancer); ok {
+		v2.ResolverError(err)
+		return
+	}
+
+	b.Balancer.HandleResolvedAddrs(nil, err)
+}
+
+func (b *configBalancer) UpdateSubConnState(sc balancer.SubConn, s balancer.SubConnState) {
+	if v2, ok := b.Balancer.(balancer.V2Balancer); ok {
+		v2.UpdateSubConnState(sc, s)
+		return
+	}
+
+	b.Balancer.HandleSubConnStateChange(sc, s.ConnectivityState)
+}
+
+// pickerRebuilder 包装base balancer使用的ClientConn和PickerBuilder，记录最近的就绪连接和更新的picker，
+// 使配置、地址或分流策略变化时能够重新生成picker
+type pickerRebuilder struct {
+	balancer.ClientConn
+	pb base.PickerBuilder
+
+	lock     sync.Mutex
+	readySCs map[resolver.Address]balancer.SubConn
+	built    balancer.Picker // 最近一次生成的picker
+	current  balancer.Picker // 最近一次更新的picker，连接全部失败时为base balancer生成的错误picker
+	state    connectivity.State
+	pending  bool // 重新生成的请求在最近生成的picker更新之前到达，更新时再重新生成
+}
+
+func (r *pickerRebuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.readySCs = readySCs
+	r.built = r.pb.Build(readySCs)
+	r.pending = false
+
+	return r.built
+}
+
+func (r *pickerRebuilder) UpdateBalancerState(s connectivity.State, p balancer.Picker) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.pending && p == r.built {
+		r.built = r.pb.Build(r.readySCs)
+		p = r.built
+	}
+	r.pending = false
+	r.state, r.current = s, p
+
+	r.ClientConn.UpdateBalancerState(s, p)
+}
+
+// rebuild 当前使用的是最近生成的picker时立即重新生成，否则等待其更新或下一次生成
+func (r *pickerRebuilder) rebuild() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.built == nil || r.current != r.built {
+		r.pending = true
+		return
+	}
+
+	r.built = r.pb.Build(r.readySCs)
+	r.current = r.built
+	r.ClientConn.UpdateBalancerState(r.state, r.current)
+}
@@ -0,0 +1,73 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+)
+
+// fakeClientConn 记录更新的picker
+type fakeClientConn struct {
+	balancer.ClientConn
+	pickers []balancer.Picker
+}
+
+func (cc *fakeClientConn) UpdateBalancerState(s connectivity.State, p balancer.Picker) {
+	cc.pickers = append(cc.pickers, p)
+}
+
+// countingPicker 记录生成时的序号
+type countingPicker struct {
+	n int
+}
+
+func (p *countingPicker) Pick(ctx context.Context, info balancer.PickInfo) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	return nil, nil, balancer.ErrNoSubConnAvailable
+}
+
+type countingPickerBuilder struct {
+	n int
+}
+
+func (b *countingPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	b.n++
+	return &countingPicker{n: b.n}
+}
+
+func TestPickerRebuild(t *testing.T) {
+	cc := &fakeClientConn{}
+	r := &pickerRebuilder{ClientConn: cc, pb: &countingPickerBuilder{}}
+	ready := map[resolver.Address]balancer.SubConn{{Addr: "a"}: &fakeSubConn{name: "a"}}
+
+	// 尚未生成picker时等待第一次更新
+	r.rebuild()
+	if len(cc.pickers) != 0 {
+		t.Fatalf("updated %d pickers before first build", len(cc.pickers))
+	}
+
+	// 生成后、更新前收到的请求在更新时处理
+	p := r.Build(ready)
+	r.rebuild()
+	r.UpdateBalancerState(connectivity.Ready, p)
+	if len(cc.pickers) != 1 || cc.pickers[0].(*countingPicker).n != 2 {
+		t.Fatalf("pickers = %v, want the rebuilt picker 2", cc.pickers)
+	}
+
+	// 使用中的picker为最近生成的时立即重新生成
+	r.rebuild()
+	if len(cc.pickers) != 2 || cc.pickers[1].(*countingPicker).n != 3 {
+		t.Fatalf("pickers = %v, want the rebuilt picker 3", cc.pickers)
+	}
+
+	// 请求之后生成的picker已经反映最新状态，不再重复生成
+	r.Build(ready)
+	r.rebuild()
+	p = r.Build(ready)
+	r.UpdateBalancerState(connectivity.Ready, p)
+	if len(cc.pickers) != 3 || cc.pickers[2] != p {
+		t.Fatalf("pickers = %v, want the built picker", cc.pickers)
+	}
+}
@@ -0,0 +1,425 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zjmnssy/serviceRD/internal/backoff"
+	"github.com/zjmnssy/serviceRD/service"
+	"github.com/zjmnssy/zlog"
+	"go.etcd.io/etcd/clientv3"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// Canary 按版本分流的负载均衡方式名称
+const Canary = "canary"
+
+const (
+	canaryKeyName   = "canary" // 分流策略在/services/pull/serviceType/common/下的名称
+	canaryTimeout   = 2000     // 读取分流策略的超时，per - Millisecond
+	canaryRetryBase = 500      // 加载或监控失败后的首次重试间隔，per - Millisecond
+	canaryRetryMax  = 10000    // 加载或监控失败后的最大重试间隔，per - Millisecond
+)
+
+// CanaryGroup 一个版本分组及其流量比例
+type CanaryGroup struct {
+	Version VersionConstraint `json:"version"` // 分组包含的版本，零值表示其余所有版本
+	Percent int               `json:"percent"` // 流量比例，各分组之和不为100时按比例分配
+}
+
+// CanaryPolicy 分流策略，保存在/services/pull/serviceType/common/canary，如
+// {"groups": [{"version": {"exact": "20261018001"}, "percent": 5}, {"percent": 95}]}，
+// 实例归属于第一个匹配的分组，没有可用实例的分组的流量按比例分给其他分组
+type CanaryPolicy struct {
+	Groups []CanaryGroup `json:"groups"`
+}
+
+// CanaryKey 某类服务分流策略的etcd路径
+func CanaryKey(layout service.KeyLayout, serviceType string) string {
+	return layout.PullCommonPrefix(serviceType) + canaryKeyName
+}
+
+// DecodeCanaryPolicy 解析分流策略
+func DecodeCanaryPolicy(value string) (CanaryPolicy, error) {
+	var policy CanaryPolicy
+	err := json.Unmarshal([]byte(value), &policy)
+	if err != nil {
+		return policy, err
+	}
+
+	for _, g := range policy.Groups {
+		if g.Percent < 0 {
+			return policy, fmt.Errorf("percent = %d error", g.Percent)
+		}
+
+		err = g.Version.validate()
+		if err != nil {
+			return policy, err
+		}
+	}
+
+	return policy, nil
+}
+
+// RegisterCanary 注册名称为Canary的负载均衡方式，分流策略从etcd中加载并在变化时立即生效，
+// 首次加载完成前不选择实例，未配置分流策略时按权重轮询，同样支持服务配置中的版本约束、异常实例检测和熔断
+func RegisterCanary(client *clientv3.Client, layout service.KeyLayout) {
+	registry := &canaryRegistry{
+		client:   client,
+		layout:   layout,
+		policies: make(map[string]*canaryWatch),
+	}
+
+	balancer.Register(newConfigBuilder(Canary, func(h *configHolder) base.PickerBuilder {
+		b := &canaryPickerBuilder{registry: registry, holder: h}
+		h.onClose(b.close)
+		return b
+	}))
+}
+
+// canaryPickerBuilder 每个grpc.ClientConn一个，引用所属服务类型的分流策略，balancer关闭时释放
+type canaryPickerBuilder struct {
+	registry *canaryRegistry
+	holder   *configHolder
+
+	lock        sync.Mutex
+	serviceType string
+	policy      *canaryHolder
+	stop        chan struct{} // 释放策略时关闭，结束等待其首次加载的goroutine
+}
+
+// Build 服务类型取自地址Metadata中的serverType，没有时取目标地址的最后一级，
+// 分流策略首次加载完成前返回ErrNoSubConnAvailable，加载完成后重新生成picker
+func (b *canaryPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	if len(readySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	serviceType := ""
+	for addr := range readySCs {
+		if m, ok := addr.Metadata.(*map[string]string); ok && m != nil {
+			serviceType = (*m)["serverType"]
+		}
+		break
+	}
+	if serviceType == "" {
+		target := b.holder.target
+		serviceType = target[strings.LastIndex(target, "/")+1:]
+	}
+
+	policy := b.acquire(serviceType)
+	if !policy.isLoaded() {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	return newVersionPicker(newSubConnInfos(readySCs), b.holder, func(infos []subConnInfo) selector {
+		return newCanarySelector(infos, policy)
+	})
+}
+
+// acquire 服务类型变化时引用新的分流策略并释放旧的
+func (b *canaryPickerBuilder) acquire(serviceType string) *canaryHolder {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.policy != nil && b.serviceType == serviceType {
+		return b.policy
+	}
+
+	policy := b.registry.acquire(serviceType)
+	if b.policy != nil {
+		b.registry.release(b.serviceType)
+		close(b.stop)
+	}
+	b.serviceType, b.policy = serviceType, policy
+	b.stop = make(chan struct{})
+
+	if !policy.isLoaded() {
+		go b.rebuildOnLoad(policy, b.stop)
+	}
+
+	return policy
+}
+
+// rebuildOnLoad 策略首次加载完成后重新生成picker，替换等待中的ErrNoSubConnAvailable
+func (b *canaryPickerBuilder) rebuildOnLoad(policy *canaryHolder, stop chan struct{}) {
+	select {
+	case <-policy.loaded:
+		{
+			b.holder.rebuild()
+		}
+	case <-stop:
+	}
+}
+
+func (b *canaryPickerBuilder) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.policy != nil {
+		b.registry.release(b.serviceType)
+		close(b.stop)
+		b.serviceType, b.policy, b.stop = "", nil, nil
+	}
+}
+
+// canarySelector 按分流策略选择分组，再在分组内按权重轮询，策略变化时重新分组，
+// 没有分组可以选择时返回nil
+type canarySelector struct {
+	infos  []subConnInfo
+	policy *canaryHolder
+	seq    int64 // 当前分组对应的策略序号
+	groups []canaryPick
+	total  int
+}
+
+type canaryPick struct {
+	percent int
+	s       selector
+}
+
+func newCanarySelector(infos []subConnInfo, policy *canaryHolder) selector {
+	return &canarySelector{infos: infos, policy: policy, seq: -1}
+}
+
+func (s *canarySelector) pick(ctx context.Context) (balancer.SubConn, func(balancer.DoneInfo)) {
+	policy, seq := s.policy.get()
+	if seq != s.seq {
+		s.regroup(policy)
+		s.seq = seq
+	}
+
+	if s.total <= 0 {
+		return nil, nil
+	}
+
+	n := rand.Intn(s.total)
+	for _, g := range s.groups {
+		if n < g.percent {
+			return g.s.pick(ctx)
+		}
+		n -= g.percent
+	}
+
+	return s.groups[len(s.groups)-1].s.pick(ctx)
+}
+
+// regroup 按策略将实例分组，没有策略时所有实例为一组
+func (s *canarySelector) regroup(policy CanaryPolicy) {
+	s.groups = s.groups[:0]
+	s.total = 0
+
+	if len(policy.Groups) == 0 {
+		s.groups = append(s.groups, canaryPick{percent: 1, s: newRoundRobinSelector(s.infos)})
+		s.total = 1
+		return
+	}
+
+	remaining := s.infos
+	for _, g := range policy.Groups {
+		members := filterVersion(remaining, g.Version)
+		if len(members) == 0 {
+			continue
+		}
+
+		assigned := make(map[balancer.SubConn]bool, len(members))
+		for _, info := range members {
+			assigned[info.sc] = true
+		}
+
+		rest := make([]subConnInfo, 0, len(remaining)-len(members))
+		for _, info := range remaining {
+			if !assigned[info.sc] {
+				rest = append(rest, info)
+			}
+		}
+		remaining = rest
+
+		if g.Percent > 0 {
+			s.groups = append(s.groups, canaryPick{percent: g.Percent, s: newRoundRobinSelector(members)})
+			s.total += g.Percent
+		}
+	}
+}
+
+// canaryHolder 某类服务当前的分流策略，seq在每次变化时递增，loaded在首次加载完成时关闭，
+// 加载完成前的零值策略不能当作未配置策略使用
+type canaryHolder struct {
+	lock   sync.Mutex
+	policy CanaryPolicy
+	seq    int64
+	loaded chan struct{}
+}
+
+func newCanaryHolder() *canaryHolder {
+	return &canaryHolder{loaded: make(chan struct{})}
+}
+
+func (h *canaryHolder) set(policy CanaryPolicy) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.policy = policy
+	h.seq++
+
+	if h.seq == 1 {
+		close(h.loaded)
+	}
+}
+
+func (h *canaryHolder) isLoaded() bool {
+	select {
+	case <-h.loaded:
+		{
+			return true
+		}
+	default:
+		{
+			return false
+		}
+	}
+}
+
+func (h *canaryHolder) get() (CanaryPolicy, int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.policy, h.seq
+}
+
+// canaryRegistry 各类服务的分流策略，每类服务首次被引用时开始监控，引用全部释放后停止监控
+type canaryRegistry struct {
+	client *clientv3.Client
+	layout service.KeyLayout
+
+	lock     sync.Mutex
+	policies map[string]*canaryWatch // key为服务类型
+}
+
+type canaryWatch struct {
+	holder *canaryHolder
+	refs   int
+	cancel context.CancelFunc
+}
+
+func (r *canaryRegistry) acquire(serviceType string) *canaryHolder {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	w, ok := r.policies[serviceType]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		w = &canaryWatch{holder: newCanaryHolder(), cancel: cancel}
+		r.policies[serviceType] = w
+		go r.watch(ctx, CanaryKey(r.layout, serviceType), w.holder)
+	}
+	w.refs++
+
+	return w.holder
+}
+
+func (r *canaryRegistry) release(serviceType string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	w, ok := r.policies[serviceType]
+	if !ok {
+		return
+	}
+
+	w.refs--
+	if w.refs <= 0 {
+		delete(r.policies, serviceType)
+		w.cancel()
+	}
+}
+
+// watch 加载并监控分流策略，失败时按指数退避重试，ctx结束时退出
+func (r *canaryRegistry) watch(ctx context.Context, key string, h *canaryHolder) {
+	for retries := 0; ; retries++ {
+		revision, err := r.load(ctx, key, h)
+		if err == nil {
+			retries = 0
+			err = r.follow(ctx, key, h, revision)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		zlog.Prints(zlog.Warn, "balancer", "watch canary policy key = %s, error = %s", key, err)
+
+		timer := time.NewTimer(backoff.Duration(time.Duration(canaryRetryBase)*time.Millisecond,
+			time.Duration(canaryRetryMax)*time.Millisecond, retries))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			{
+				timer.Stop()
+				return
+			}
+		}
+	}
+}
+
+// load 读取策略，返回读取时的revision
+func (r *canaryRegistry) load(ctx context.Context, key string, h *canaryHolder) (int64, error) {
+	ctxNow, cancel := context.WithTimeout(ctx, time.Duration(canaryTimeout)*time.Millisecond)
+	defer cancel()
+
+	resp, err := r.client.Get(ctxNow, key)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		h.set(CanaryPolicy{})
+	} else {
+		r.update(key, string(resp.Kvs[0].Value), h)
+	}
+
+	return resp.Header.Revision, nil
+}
+
+// follow 从revision的下一个版本开始监控策略，监控中断时返回
+func (r *canaryRegistry) follow(ctx context.Context, key string, h *canaryHolder, revision int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for wresp := range r.client.Watch(ctx, key, clientv3.WithRev(revision+1)) {
+		if wresp.Err() != nil {
+			return wresp.Err()
+		}
+
+		for _, ev := range wresp.Events {
+			if ev.Type == clientv3.EventTypeDelete {
+				zlog.Prints(zlog.Info, "balancer", "canary policy key = %s deleted", key)
+				h.set(CanaryPolicy{})
+				continue
+			}
+
+			r.update(key, string(ev.Kv.Value), h)
+		}
+	}
+
+	return fmt.Errorf("watch channel closed")
+}
+
+// update 策略格式错误时保持原策略，首次加载的策略格式错误时仍视为未加载
+func (r *canaryRegistry) update(key string, value string, h *canaryHolder) {
+	policy, err := DecodeCanaryPolicy(value)
+	if err != nil {
+		zlog.Prints(zlog.Warn, "balancer", "canary policy key = %s, value = %s, error = %s", key, value, err)
+		return
+	}
+
+	zlog.Prints(zlog.Info, "balancer", "canary policy key = %s, value = %s", key, value)
+	h.set(policy)
+}
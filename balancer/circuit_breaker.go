@@ -0,0 +1,344 @@
+package balancer
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zjmnssy/zlog"
+)
+
+// 熔断器的默认值
+const (
+	defaultFailureThreshold = 5     // 连续失败次数
+	defaultOpenTimeout      = 10000 // 熔断后多久进入半开状态，per - Millisecond
+	defaultHalfOpenProbes   = 3     // 半开状态下的探测请求数
+)
+
+// CircuitState 熔断器状态
+type CircuitState int
+
+// 熔断器状态
+const (
+	CircuitClosed   CircuitState = iota // 正常
+	CircuitOpen                         // 熔断中，不再选择此实例
+	CircuitHalfOpen                     // 半开，允许少量探测请求
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		{
+			return "closed"
+		}
+	case CircuitOpen:
+		{
+			return "open"
+		}
+	case CircuitHalfOpen:
+		{
+			return "half-open"
+		}
+	default:
+		{
+			return fmt.Sprintf("CircuitState(%d)", int(s))
+		}
+	}
+}
+
+// BreakerConfig 熔断器配置，零值字段使用默认值，通过服务配置中的circuitBreaker设置
+type BreakerConfig struct {
+	Disabled         bool `json:"disabled,omitempty"`         // 关闭熔断
+	FailureThreshold int  `json:"failureThreshold,omitempty"` // 连续失败多少次后熔断
+	OpenTimeout      int  `json:"openTimeout,omitempty"`      // 熔断后多久进入半开状态，per - Millisecond
+	HalfOpenProbes   int  `json:"halfOpenProbes,omitempty"`   // 半开状态下同时允许的探测请求数，全部成功后恢复
+}
+
+func (c BreakerConfig) validate() error {
+	if c.FailureThreshold < 0 || c.OpenTimeout < 0 || c.HalfOpenProbes < 0 {
+		return fmt.Errorf("circuit breaker config %+v has negative value", c)
+	}
+
+	return nil
+}
+
+func (c BreakerConfig) withDefault() BreakerConfig {
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = defaultFailureThreshold
+	}
+	if c.OpenTimeout == 0 {
+		c.OpenTimeout = defaultOpenTimeout
+	}
+	if c.HalfOpenProbes == 0 {
+		c.HalfOpenProbes = defaultHalfOpenProbes
+	}
+
+	return c
+}
+
+// CircuitStatus 实例熔断器的当前状态
+type CircuitStatus struct {
+	ServerType          string
+	ServerID            string
+	State               CircuitState
+	ConsecutiveFailures int
+	OpenedAt            time.Time // 最近一次熔断的时间
+}
+
+// circuitBreaker 单个实例的熔断器，同一进程内的所有grpc.ClientConn共用，使用最近一次设置的配置，
+// 状态变化时通知引用它的configHolder，holders由注册表的锁保护，其他字段由自身的锁保护
+type circuitBreaker struct {
+	serverType  string
+	serverID    string
+	holders     map[*configHolder]int // 引用此熔断器的configHolder及引用数
+	lock        sync.Mutex
+	config      BreakerConfig
+	state       CircuitState
+	consecutive int
+	openedAt    time.Time
+	probes      int // 半开状态下未完成的探测请求数
+	probeOK     int // 半开状态下成功的探测请求数
+}
+
+// breakerKey 熔断器的key，不同服务类型的实例ID可能相同
+func breakerKey(serverType string, serverID string) string {
+	return serverType + "/" + serverID
+}
+
+// breakerRegistry 所有实例的熔断器，key为breakerKey，每次调用只持有读锁和单个熔断器的锁
+type breakerRegistry struct {
+	lock     sync.RWMutex
+	breakers map[string]*circuitBreaker
+}
+
+var breakers = &breakerRegistry{breakers: make(map[string]*circuitBreaker)}
+
+// CircuitStates 获取所有实例熔断器的状态，key为serverType/serverID
+func CircuitStates() map[string]CircuitStatus {
+	breakers.lock.RLock()
+	defer breakers.lock.RUnlock()
+
+	now := time.Now()
+
+	states := make(map[string]CircuitStatus, len(breakers.breakers))
+	for key, b := range breakers.breakers {
+		b.lock.Lock()
+		b.expire(now)
+
+		states[key] = CircuitStatus{
+			ServerType:          b.serverType,
+			ServerID:            b.serverID,
+			State:               b.state,
+			ConsecutiveFailures: b.consecutive,
+			OpenedAt:            b.openedAt,
+		}
+		b.lock.Unlock()
+	}
+
+	return states
+}
+
+// acquire 增加h对实例熔断器的引用并更新配置
+func (r *breakerRegistry) acquire(infos []subConnInfo, config BreakerConfig, h *configHolder) {
+	config = config.withDefault()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, info := range infos {
+		key := info.breakerKey()
+
+		b, ok := r.breakers[key]
+		if !ok {
+			b = &circuitBreaker{serverType: info.serverType, serverID: info.id, holders: make(map[*configHolder]int)}
+			r.breakers[key] = b
+		}
+		b.lock.Lock()
+		b.config = config
+		b.lock.Unlock()
+		b.holders[h]++
+	}
+}
+
+// release 减少h对实例熔断器的引用，没有引用时删除
+func (r *breakerRegistry) release(keys []string, h *configHolder) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, key := range keys {
+		b, ok := r.breakers[key]
+		if !ok {
+			continue
+		}
+
+		b.holders[h]--
+		if b.holders[h] <= 0 {
+			delete(b.holders, h)
+		}
+		if len(b.holders) == 0 {
+			delete(r.breakers, key)
+		}
+	}
+}
+
+// expire 熔断到期时转为半开状态，只在访问此熔断器时检查，需持有注册表的读锁和自身的锁
+func (b *circuitBreaker) expire(now time.Time) {
+	if b.state != CircuitOpen || now.Before(b.reopenAt()) {
+		return
+	}
+
+	b.state = CircuitHalfOpen
+	b.probes = 0
+	b.probeOK = 0
+	b.changed()
+
+	zlog.Prints(zlog.Info, "balancer", "circuit of %s half-open", breakerKey(b.serverType, b.serverID))
+}
+
+// reopenAt 熔断后进入半开状态的时间
+func (b *circuitBreaker) reopenAt() time.Time {
+	return b.openedAt.Add(time.Duration(b.config.OpenTimeout) * time.Millisecond)
+}
+
+// changed 状态变化，通知引用此熔断器的picker重新生成候选列表，需持有注册表的读锁和自身的锁
+func (b *circuitBreaker) changed() {
+	for h := range b.holders {
+		atomic.AddInt64(&h.breakerSeq, 1)
+	}
+}
+
+// state 实例熔断器的当前状态，熔断中时同时返回进入半开状态的时间
+func (r *breakerRegistry) state(key string) (CircuitState, time.Time) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	b, ok := r.breakers[key]
+	if !ok {
+		return CircuitClosed, time.Time{}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.config.Disabled {
+		return CircuitClosed, time.Time{}
+	}
+
+	b.expire(time.Now())
+
+	if b.state == CircuitOpen {
+		return b.state, b.reopenAt()
+	}
+
+	return b.state, time.Time{}
+}
+
+// allow 是否允许向实例发送请求，半开状态下超过探测数时拒绝，probe表示本次请求为探测请求
+func (r *breakerRegistry) allow(key string) (allowed bool, probe bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	b, ok := r.breakers[key]
+	if !ok {
+		return true, false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.config.Disabled {
+		return true, false
+	}
+
+	b.expire(time.Now())
+
+	switch b.state {
+	case CircuitOpen:
+		{
+			return false, false
+		}
+	case CircuitHalfOpen:
+		{
+			if b.probes >= b.config.HalfOpenProbes {
+				return false, false
+			}
+
+			b.probes++
+
+			return true, true
+		}
+	default:
+		{
+			return true, false
+		}
+	}
+}
+
+// record 记录一次调用结果，熔断期间开始的请求和半开状态下的非探测请求不影响状态
+func (r *breakerRegistry) record(key string, probe bool, err error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	b, ok := r.breakers[key]
+	if !ok {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.config.Disabled {
+		return
+	}
+
+	failed := isBackendError(err)
+
+	switch b.state {
+	case CircuitClosed:
+		{
+			if !failed {
+				b.consecutive = 0
+				return
+			}
+
+			b.consecutive++
+			if b.consecutive >= b.config.FailureThreshold {
+				b.open(fmt.Sprintf("%d consecutive failures", b.consecutive))
+			}
+		}
+	case CircuitHalfOpen:
+		{
+			if !probe {
+				return
+			}
+
+			b.probes--
+
+			if failed {
+				b.open("probe failed")
+				return
+			}
+
+			b.probeOK++
+			if b.probeOK >= b.config.HalfOpenProbes {
+				b.state = CircuitClosed
+				b.consecutive = 0
+				b.changed()
+
+				zlog.Prints(zlog.Info, "balancer", "circuit of %s closed", breakerKey(b.serverType, b.serverID))
+			}
+		}
+	}
+}
+
+// open 熔断，需持有注册表的读锁和自身的锁
+func (b *circuitBreaker) open(reason string) {
+	b.state = CircuitOpen
+	b.openedAt = time.Now()
+	b.probes = 0
+	b.probeOK = 0
+	b.changed()
+
+	zlog.Prints(zlog.Warn, "balancer", "circuit of %s open, reason = %s", breakerKey(b.serverType, b.serverID), reason)
+}
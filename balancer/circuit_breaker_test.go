@@ -0,0 +1,123 @@
+package balancer
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errBackend = status.Error(codes.Unavailable, "backend unavailable")
+
+// breakerPicker 熔断一次失败即打开、20ms后半开、只允许一个探测请求，不做异常实例检测
+func breakerPicker(infos []subConnInfo, newSelector func(infos []subConnInfo) selector) (*versionPicker, *configHolder) {
+	h := &configHolder{outlier: newOutlierDetector()}
+	h.set(Config{
+		Outlier: OutlierConfig{Disabled: true},
+		Breaker: BreakerConfig{FailureThreshold: 1, OpenTimeout: 20, HalfOpenProbes: 1},
+	})
+
+	return newVersionPicker(infos, h, newSelector), h
+}
+
+func typedInfos(serverType string, weights ...int) []subConnInfo {
+	infos := testInfos(weights...)
+	for i := range infos {
+		infos[i].serverType = serverType
+	}
+
+	return infos
+}
+
+func mustPick(ctx context.Context, t *testing.T, p *versionPicker) (balancer.SubConn, func(balancer.DoneInfo)) {
+	t.Helper()
+
+	sc, done, err := p.Pick(ctx, balancer.PickInfo{})
+	if err != nil {
+		t.Fatalf("pick error = %s", err)
+	}
+
+	return sc, done
+}
+
+func TestBreakerKeyedByServerType(t *testing.T) {
+	a, ha := breakerPicker(typedInfos("breaker-type-a", 1), newRoundRobinSelector)
+	defer ha.close()
+	b, hb := breakerPicker(typedInfos("breaker-type-b", 1), newRoundRobinSelector)
+	defer hb.close()
+
+	// 两类服务的实例ID相同，熔断互不影响
+	_, done := mustPick(context.Background(), t, a)
+	done(balancer.DoneInfo{Err: errBackend})
+
+	if _, _, err := a.Pick(context.Background(), balancer.PickInfo{}); err == nil || !strings.Contains(err.Error(), "are open") {
+		t.Fatalf("pick error = %v, want circuit open", err)
+	}
+
+	mustPick(context.Background(), t, b)
+}
+
+func TestRingHashSkipsFullHalfOpen(t *testing.T) {
+	infos := typedInfos("breaker-ring", 1, 1)
+	p, h := breakerPicker(infos, func(infos []subConnInfo) selector {
+		return newRingHashSelector(infos, DefaultHashHeader)
+	})
+	defer h.close()
+
+	ctx := WithHashKey(context.Background(), "user-1")
+	first, done := mustPick(ctx, t, p)
+	done(balancer.DoneInfo{Err: errBackend})
+
+	// 熔断期间改由另一个实例处理
+	other, done := mustPick(ctx, t, p)
+	if other == first {
+		t.Fatalf("picked open subconn %s", first.(*fakeSubConn).name)
+	}
+	done(balancer.DoneInfo{})
+
+	// 到期后同一个key重新选中半开实例作为探测请求
+	time.Sleep(30 * time.Millisecond)
+	probe, probeDone := mustPick(ctx, t, p)
+	if probe != first {
+		t.Fatalf("picked %s, want half-open %s", probe.(*fakeSubConn).name, first.(*fakeSubConn).name)
+	}
+
+	// 探测未完成时不再选择半开实例
+	sc, done := mustPick(ctx, t, p)
+	if sc != other {
+		t.Fatalf("picked %s while probe in flight, want %s", sc.(*fakeSubConn).name, other.(*fakeSubConn).name)
+	}
+	done(balancer.DoneInfo{})
+
+	// 探测成功后恢复
+	probeDone(balancer.DoneInfo{})
+	sc, _ = mustPick(ctx, t, p)
+	if sc != first {
+		t.Fatalf("picked %s after recovery, want %s", sc.(*fakeSubConn).name, first.(*fakeSubConn).name)
+	}
+}
+
+func TestAllCircuitsOpen(t *testing.T) {
+	p, h := breakerPicker(typedInfos("breaker-all", 1, 1), newRoundRobinSelector)
+	defer h.close()
+
+	for i := 0; i < 2; i++ {
+		_, done := mustPick(context.Background(), t, p)
+		done(balancer.DoneInfo{Err: errBackend})
+	}
+
+	_, _, err := p.Pick(context.Background(), balancer.PickInfo{})
+	if err == nil || !strings.Contains(err.Error(), "circuit breakers of all instances") {
+		t.Fatalf("pick error = %v, want all circuits open", err)
+	}
+
+	// 版本约束无实例匹配时仍然报告版本约束
+	_, _, err = p.Pick(WithVersion(context.Background(), ExactVersion("20190828001")), balancer.PickInfo{})
+	if err == nil || !strings.Contains(err.Error(), "no available instance matches version constraint") {
+		t.Fatalf("pick error = %v, want no instance matches version", err)
+	}
+}
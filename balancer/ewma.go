@@ -0,0 +1,202 @@
+package balancer
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+// EWMA 按延迟和错误率加权的负载均衡方式名称
+const EWMA = "ewma"
+
+const (
+	ewmaDecay        = 10000 // 平均值的衰减时间，per - Millisecond
+	ewmaBaseLatency  = 1     // 延迟的基础值，避免无延迟数据时只按未完成请求数比较，per - Millisecond
+	ewmaErrorPenalty = 10    // 错误率为1时开销放大的倍数
+	ewmaProbeRate    = 0.02  // 随机探测的概率，使被降权的实例恢复后能重新获得流量
+)
+
+func newEWMABuilder() balancer.Builder {
+	return newConfigBuilder(EWMA, func(h *configHolder) base.PickerBuilder {
+		return &ewmaPickerBuilder{holder: h, stats: make(map[balancer.SubConn]*ewmaStats)}
+	})
+}
+
+// 注意：需要在包初始化的时候注册到grpc中
+func init() {
+	balancer.Register(newEWMABuilder())
+}
+
+// ewmaPickerBuilder 每个grpc.ClientConn一个，统计数据在重新生成picker时保留
+type ewmaPickerBuilder struct {
+	holder *configHolder
+
+	lock  sync.Mutex
+	stats map[balancer.SubConn]*ewmaStats
+}
+
+// Build 支持权重和版本约束
+func (b *ewmaPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	if len(readySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	b.lock.Lock()
+	stats := make(map[balancer.SubConn]*ewmaStats, len(readySCs))
+	for _, sc := range readySCs {
+		st, ok := b.stats[sc]
+		if !ok {
+			st = &ewmaStats{}
+		}
+		stats[sc] = st
+	}
+	b.stats = stats
+	b.lock.Unlock()
+
+	newSelector := func(infos []subConnInfo) selector {
+		return newEWMASelector(infos, stats)
+	}
+
+	return newVersionPicker(newSubConnInfos(readySCs), b.holder, newSelector)
+}
+
+// ewmaStats 单个连接的延迟、错误率的指数加权移动平均值，以及未完成请求数
+type ewmaStats struct {
+	lock     sync.Mutex
+	latency  float64 // 纳秒
+	errRate  float64 // [0, 1]
+	inflight int64
+	updated  time.Time
+}
+
+// decayWeight 距离上次更新elapsed时间后，旧平均值保留的比例
+func decayWeight(elapsed time.Duration) float64 {
+	return math.Exp(-float64(elapsed) / float64(time.Duration(ewmaDecay)*time.Millisecond))
+}
+
+// start 开始一次请求
+func (s *ewmaStats) start() {
+	s.lock.Lock()
+	s.inflight++
+	s.lock.Unlock()
+}
+
+// cancel 请求未发出
+func (s *ewmaStats) cancel() {
+	s.lock.Lock()
+	s.inflight--
+	s.lock.Unlock()
+}
+
+// done 请求结束，更新平均延迟和错误率，首次请求直接使用本次的值
+func (s *ewmaStats) done(latency time.Duration, failed bool) {
+	now := time.Now()
+
+	errValue := 0.0
+	if failed {
+		errValue = 1
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.inflight--
+
+	if s.updated.IsZero() {
+		s.latency = float64(latency)
+		s.errRate = errValue
+		s.updated = now
+		return
+	}
+
+	w := decayWeight(now.Sub(s.updated))
+	s.latency = s.latency*w + float64(latency)*(1-w)
+	s.errRate = s.errRate*w + errValue*(1-w)
+	s.updated = now
+}
+
+// cost 选择此连接的开销，延迟越大、未完成请求越多、错误率越高开销越大，权重越大开销越小，
+// 长时间没有请求时错误率逐渐衰减
+func (s *ewmaStats) cost(weight int) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	errRate := s.errRate
+	if !s.updated.IsZero() {
+		errRate *= decayWeight(time.Since(s.updated))
+	}
+
+	latency := s.latency + float64(time.Duration(ewmaBaseLatency)*time.Millisecond)
+
+	return latency * float64(s.inflight+1) * (1 + ewmaErrorPenalty*errRate) / float64(weight)
+}
+
+// isBackendError 是否为后端不可用导致的错误，业务错误不计入错误率
+func isBackendError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.ResourceExhausted, codes.DataLoss:
+		{
+			return true
+		}
+	default:
+		{
+			return false
+		}
+	}
+}
+
+// ewmaSelector 随机选择两个实例（P2C），选择开销较小的一个，偶尔随机探测
+type ewmaSelector struct {
+	infos []subConnInfo
+	stats []*ewmaStats
+}
+
+func newEWMASelector(infos []subConnInfo, stats map[balancer.SubConn]*ewmaStats) selector {
+	s := &ewmaSelector{infos: infos, stats: make([]*ewmaStats, 0, len(infos))}
+
+	for _, info := range infos {
+		s.stats = append(s.stats, stats[info.sc])
+	}
+
+	return s
+}
+
+func (s *ewmaSelector) pick(ctx context.Context) (balancer.SubConn, func(balancer.DoneInfo)) {
+	i := rand.Intn(len(s.infos))
+
+	if len(s.infos) > 1 && rand.Float64() >= ewmaProbeRate {
+		j := rand.Intn(len(s.infos) - 1)
+		if j >= i {
+			j++
+		}
+
+		if s.stats[j].cost(s.infos[j].weight) < s.stats[i].cost(s.infos[i].weight) {
+			i = j
+		}
+	}
+
+	st := s.stats[i]
+	st.start()
+	begin := time.Now()
+
+	return s.infos[i].sc, func(info balancer.DoneInfo) {
+		if info.Err == errPickRejected {
+			st.cancel()
+			return
+		}
+
+		st.done(time.Since(begin), isBackendError(info.Err))
+	}
+}
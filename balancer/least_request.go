@@ -0,0 +1,112 @@
+package balancer
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// LeastRequest 最少未完成请求负载均衡方式名称
+const LeastRequest = "least_request"
+
+func newLeastRequestBuilder() balancer.Builder {
+	return newConfigBuilder(LeastRequest, func(h *configHolder) base.PickerBuilder {
+		return &leastRequestPickerBuilder{holder: h, inflight: make(map[balancer.SubConn]*int64)}
+	})
+}
+
+// 注意：需要在包初始化的时候注册到grpc中
+func init() {
+	balancer.Register(newLeastRequestBuilder())
+}
+
+// leastRequestPickerBuilder 每个grpc.ClientConn一个，未完成请求数在重新生成picker时保留
+type leastRequestPickerBuilder struct {
+	holder *configHolder
+
+	lock     sync.Mutex
+	inflight map[balancer.SubConn]*int64
+}
+
+// Build 支持权重和版本约束
+func (b *leastRequestPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	if len(readySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	b.lock.Lock()
+	inflight := make(map[balancer.SubConn]*int64, len(readySCs))
+	for _, sc := range readySCs {
+		counter, ok := b.inflight[sc]
+		if !ok {
+			counter = new(int64)
+		}
+		inflight[sc] = counter
+	}
+	// 已移除连接上未完成的请求结束时仍会更新原计数器，不影响新的picker
+	b.inflight = inflight
+	b.lock.Unlock()
+
+	newSelector := func(infos []subConnInfo) selector {
+		return newLeastRequestSelector(infos, inflight)
+	}
+
+	return newVersionPicker(newSubConnInfos(readySCs), b.holder, newSelector)
+}
+
+// leastRequestSelector 随机选择两个实例（P2C），选择未完成请求数与权重之比较小的一个
+type leastRequestSelector struct {
+	items []leastRequestItem
+}
+
+type leastRequestItem struct {
+	sc       balancer.SubConn
+	weight   int64
+	inflight *int64
+}
+
+func newLeastRequestSelector(infos []subConnInfo, inflight map[balancer.SubConn]*int64) selector {
+	s := &leastRequestSelector{items: make([]leastRequestItem, 0, len(infos))}
+
+	for _, info := range infos {
+		s.items = append(s.items, leastRequestItem{
+			sc:       info.sc,
+			weight:   int64(info.weight),
+			inflight: inflight[info.sc],
+		})
+	}
+
+	return s
+}
+
+func (s *leastRequestSelector) pick(ctx context.Context) (balancer.SubConn, func(balancer.DoneInfo)) {
+	item := s.items[0]
+
+	if len(s.items) > 1 {
+		i := rand.Intn(len(s.items))
+		j := rand.Intn(len(s.items) - 1)
+		if j >= i {
+			j++
+		}
+
+		a, b := s.items[i], s.items[j]
+
+		// 比较 (inflight+1)/weight，交叉相乘避免浮点运算
+		if (atomic.LoadInt64(a.inflight)+1)*b.weight <= (atomic.LoadInt64(b.inflight)+1)*a.weight {
+			item = a
+		} else {
+			item = b
+		}
+	}
+
+	atomic.AddInt64(item.inflight, 1)
+
+	return item.sc, func(balancer.DoneInfo) {
+		atomic.AddInt64(item.inflight, -1)
+	}
+}
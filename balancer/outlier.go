@@ -0,0 +1,313 @@
+package balancer
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zjmnssy/zlog"
+	"google.golang.org/grpc/balancer"
+)
+
+// 异常实例检测的默认值
+const (
+	defaultOutlierInterval       = 10000  // 成功率统计周期，per - Millisecond
+	defaultConsecutiveFailures   = 5      // 连续失败次数
+	defaultBaseEjectionTime      = 30000  // 首次摘除时间，per - Millisecond
+	defaultMaxEjectionTime       = 300000 // 最长摘除时间，per - Millisecond
+	defaultMaxEjectionPercent    = 50     // 最多摘除的实例比例
+	defaultSuccessRateStdevScale = 1.9    // 成功率低于平均值减去此倍数的标准差时摘除
+	defaultSuccessRateMinHosts   = 3      // 请求量足够的实例数达到此值才按成功率检测
+	defaultSuccessRateVolume     = 10     // 统计周期内请求数达到此值的实例才参与成功率检测
+)
+
+// OutlierConfig 异常实例检测配置，零值字段使用默认值，通过服务配置中的outlierDetection设置
+type OutlierConfig struct {
+	Disabled                 bool    `json:"disabled,omitempty"`                 // 关闭检测
+	Interval                 int     `json:"interval,omitempty"`                 // 成功率统计周期，per - Millisecond
+	ConsecutiveFailures      int     `json:"consecutiveFailures,omitempty"`      // 连续失败多少次后摘除
+	BaseEjectionTime         int     `json:"baseEjectionTime,omitempty"`         // 首次摘除时间，之后每次摘除时间翻倍，per - Millisecond
+	MaxEjectionTime          int     `json:"maxEjectionTime,omitempty"`          // 最长摘除时间，per - Millisecond
+	MaxEjectionPercent       int     `json:"maxEjectionPercent,omitempty"`       // 最多摘除的实例比例，[1, 100]
+	SuccessRateStdevFactor   float64 `json:"successRateStdevFactor,omitempty"`   // 成功率低于平均值减去此倍数的标准差时摘除
+	SuccessRateMinHosts      int     `json:"successRateMinHosts,omitempty"`      // 参与成功率检测的最少实例数
+	SuccessRateRequestVolume int     `json:"successRateRequestVolume,omitempty"` // 参与成功率检测的实例在统计周期内的最少请求数
+}
+
+func (c OutlierConfig) validate() error {
+	if c.Interval < 0 || c.ConsecutiveFailures < 0 || c.BaseEjectionTime < 0 || c.MaxEjectionTime < 0 ||
+		c.SuccessRateStdevFactor < 0 || c.SuccessRateMinHosts < 0 || c.SuccessRateRequestVolume < 0 {
+		return fmt.Errorf("outlier detection config %+v has negative value", c)
+	}
+
+	if c.MaxEjectionPercent < 0 || c.MaxEjectionPercent > 100 {
+		return fmt.Errorf("maxEjectionPercent = %d error, want [1, 100]", c.MaxEjectionPercent)
+	}
+
+	return nil
+}
+
+func (c OutlierConfig) withDefault() OutlierConfig {
+	if c.Interval == 0 {
+		c.Interval = defaultOutlierInterval
+	}
+	if c.ConsecutiveFailures == 0 {
+		c.ConsecutiveFailures = defaultConsecutiveFailures
+	}
+	if c.BaseEjectionTime == 0 {
+		c.BaseEjectionTime = defaultBaseEjectionTime
+	}
+	if c.MaxEjectionTime == 0 {
+		c.MaxEjectionTime = defaultMaxEjectionTime
+	}
+	if c.MaxEjectionPercent == 0 {
+		c.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+	if c.SuccessRateStdevFactor == 0 {
+		c.SuccessRateStdevFactor = defaultSuccessRateStdevScale
+	}
+	if c.SuccessRateMinHosts == 0 {
+		c.SuccessRateMinHosts = defaultSuccessRateMinHosts
+	}
+	if c.SuccessRateRequestVolume == 0 {
+		c.SuccessRateRequestVolume = defaultSuccessRateVolume
+	}
+
+	return c
+}
+
+// outlierHost 单个连接的检测数据
+type outlierHost struct {
+	consecutive  int       // 连续失败次数
+	success      int       // 本统计周期内成功次数
+	failure      int       // 本统计周期内失败次数
+	ejections    int       // 摘除倍数，决定下次摘除时间，长时间正常后逐渐减小
+	ejectedUntil time.Time // 摘除结束时间，零值表示未摘除
+	lastEjected  time.Time // 最近一次摘除的时间
+}
+
+// outlierDetector 单个grpc.ClientConn的异常实例检测，根据调用结果摘除连续失败或成功率明显偏低的连接，
+// 摘除到期后自动恢复，seq在摘除状态变化时递增，picker据此重新生成候选列表
+type outlierDetector struct {
+	seq         int64 // atomic访问，放在前面保证64位对齐
+	nextCheck   int64 // 最早的摘除到期或统计周期结束时间，per - Nanosecond，atomic访问，之前的check无需加锁
+	lock        sync.Mutex
+	config      OutlierConfig
+	hosts       map[balancer.SubConn]*outlierHost
+	windowStart time.Time
+}
+
+func newOutlierDetector() *outlierDetector {
+	d := &outlierDetector{
+		config:      OutlierConfig{}.withDefault(),
+		hosts:       make(map[balancer.SubConn]*outlierHost),
+		windowStart: time.Now(),
+	}
+	d.schedule()
+
+	return d
+}
+
+// update 更新配置和可用连接，保留已有连接的检测数据
+func (d *outlierDetector) update(infos []subConnInfo, config OutlierConfig) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.config = config.withDefault()
+
+	hosts := make(map[balancer.SubConn]*outlierHost, len(infos))
+	for _, info := range infos {
+		h, ok := d.hosts[info.sc]
+		if !ok {
+			h = &outlierHost{}
+		}
+		hosts[info.sc] = h
+	}
+	d.hosts = hosts
+	d.changed()
+	d.schedule()
+}
+
+// changed 摘除状态变化，需持有锁
+func (d *outlierDetector) changed() {
+	atomic.AddInt64(&d.seq, 1)
+}
+
+// schedule 计算下一次需要check处理的时间，需持有锁
+func (d *outlierDetector) schedule() {
+	if d.config.Disabled {
+		atomic.StoreInt64(&d.nextCheck, math.MaxInt64)
+		return
+	}
+
+	next := d.windowStart.Add(time.Duration(d.config.Interval) * time.Millisecond)
+	for _, h := range d.hosts {
+		if !h.ejectedUntil.IsZero() && h.ejectedUntil.Before(next) {
+			next = h.ejectedUntil
+		}
+	}
+
+	atomic.StoreInt64(&d.nextCheck, next.UnixNano())
+}
+
+// check 恢复到期的连接，统计周期结束时按成功率检测，返回当前的状态序号，
+// 每次选择连接时调用，没有到期的摘除且统计周期未结束时不加锁直接返回
+func (d *outlierDetector) check() int64 {
+	now := time.Now()
+	if now.UnixNano() < atomic.LoadInt64(&d.nextCheck) {
+		return atomic.LoadInt64(&d.seq)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.config.Disabled {
+		return atomic.LoadInt64(&d.seq)
+	}
+
+	for sc, h := range d.hosts {
+		if !h.ejectedUntil.IsZero() && !now.Before(h.ejectedUntil) {
+			zlog.Prints(zlog.Info, "balancer", "outlier subConn %p restored", sc)
+			h.ejectedUntil = time.Time{}
+			h.consecutive = 0
+			d.changed()
+		}
+	}
+
+	if now.Sub(d.windowStart) >= time.Duration(d.config.Interval)*time.Millisecond {
+		d.evaluate(now)
+	}
+
+	d.schedule()
+
+	return atomic.LoadInt64(&d.seq)
+}
+
+// ejected 当前被摘除的连接
+func (d *outlierDetector) ejected() map[balancer.SubConn]bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	result := make(map[balancer.SubConn]bool)
+	if d.config.Disabled {
+		return result
+	}
+
+	for sc, h := range d.hosts {
+		if !h.ejectedUntil.IsZero() {
+			result[sc] = true
+		}
+	}
+
+	return result
+}
+
+// record 记录一次调用结果，后端错误计为失败
+func (d *outlierDetector) record(sc balancer.SubConn, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	h, ok := d.hosts[sc]
+	if !ok || d.config.Disabled || !h.ejectedUntil.IsZero() {
+		return
+	}
+
+	if !isBackendError(err) {
+		h.success++
+		h.consecutive = 0
+		return
+	}
+
+	h.failure++
+	h.consecutive++
+	if h.consecutive >= d.config.ConsecutiveFailures {
+		d.eject(sc, h, time.Now(), fmt.Sprintf("%d consecutive failures", h.consecutive))
+	}
+}
+
+// evaluate 统计周期结束，摘除成功率低于平均值减去若干倍标准差的连接，并重新开始统计
+func (d *outlierDetector) evaluate(now time.Time) {
+	type sample struct {
+		sc   balancer.SubConn
+		h    *outlierHost
+		rate float64
+	}
+
+	samples := make([]sample, 0, len(d.hosts))
+	for sc, h := range d.hosts {
+		total := h.success + h.failure
+		if h.ejectedUntil.IsZero() && total >= d.config.SuccessRateRequestVolume {
+			samples = append(samples, sample{sc: sc, h: h, rate: float64(h.success) / float64(total)})
+		}
+	}
+
+	if len(samples) >= d.config.SuccessRateMinHosts {
+		mean := 0.0
+		for _, s := range samples {
+			mean += s.rate
+		}
+		mean /= float64(len(samples))
+
+		variance := 0.0
+		for _, s := range samples {
+			variance += (s.rate - mean) * (s.rate - mean)
+		}
+		stdev := math.Sqrt(variance / float64(len(samples)))
+
+		threshold := mean - d.config.SuccessRateStdevFactor*stdev
+		for _, s := range samples {
+			if s.rate < threshold {
+				d.eject(s.sc, s.h, now, fmt.Sprintf("success rate %.3f below %.3f", s.rate, threshold))
+			}
+		}
+	}
+
+	// 一个统计周期内未被摘除的连接，摘除倍数逐渐减小
+	for _, h := range d.hosts {
+		if h.ejectedUntil.IsZero() && h.ejections > 0 && h.lastEjected.Before(d.windowStart) {
+			h.ejections--
+		}
+
+		h.success = 0
+		h.failure = 0
+	}
+
+	d.windowStart = now
+}
+
+// eject 摘除连接，摘除时间随摘除倍数指数增长，被摘除的连接数不超过最大比例
+func (d *outlierDetector) eject(sc balancer.SubConn, h *outlierHost, now time.Time, reason string) {
+	ejected := 0
+	for _, other := range d.hosts {
+		if !other.ejectedUntil.IsZero() {
+			ejected++
+		}
+	}
+
+	if float64(ejected+1)*100 > float64(len(d.hosts)*d.config.MaxEjectionPercent) {
+		h.consecutive = 0
+		return
+	}
+
+	duration := time.Duration(d.config.BaseEjectionTime) * time.Millisecond
+	max := time.Duration(d.config.MaxEjectionTime) * time.Millisecond
+	for i := 0; i < h.ejections && duration < max; i++ {
+		duration *= 2
+	}
+	if duration > max {
+		duration = max
+	}
+	if duration < max {
+		h.ejections++
+	}
+
+	h.ejectedUntil = now.Add(duration)
+	h.lastEjected = now
+	h.consecutive = 0
+	d.changed()
+	d.schedule()
+
+	zlog.Prints(zlog.Warn, "balancer", "outlier subConn %p ejected for %s, reason = %s", sc, duration, reason)
+}
@@ -0,0 +1,98 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+)
+
+func recordN(d *outlierDetector, info subConnInfo, n int, err error) {
+	for i := 0; i < n; i++ {
+		d.record(info.sc, err)
+	}
+}
+
+func TestOutlierConsecutiveFailures(t *testing.T) {
+	infos := testInfos(1, 1, 1, 1)
+	d := newOutlierDetector()
+	d.update(infos, OutlierConfig{ConsecutiveFailures: 3, BaseEjectionTime: 20})
+	seq := d.check()
+
+	// 成功的调用重新开始计数
+	recordN(d, infos[0], 2, errBackend)
+	d.record(infos[0].sc, nil)
+	recordN(d, infos[0], 2, errBackend)
+	if d.ejected()[infos[0].sc] || d.check() != seq {
+		t.Fatalf("%s ejected before 3 consecutive failures", infos[0].id)
+	}
+
+	d.record(infos[0].sc, errBackend)
+	if !d.ejected()[infos[0].sc] || d.check() == seq {
+		t.Fatalf("%s not ejected after 3 consecutive failures", infos[0].id)
+	}
+
+	// 摘除到期后恢复
+	time.Sleep(30 * time.Millisecond)
+	d.check()
+	if len(d.ejected()) != 0 {
+		t.Fatalf("ejected = %v after ejection time", d.ejected())
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	infos := testInfos(1, 1, 1, 1)
+	d := newOutlierDetector()
+	d.update(infos, OutlierConfig{ConsecutiveFailures: 1, MaxEjectionPercent: 50})
+
+	for _, info := range infos {
+		d.record(info.sc, errBackend)
+	}
+
+	ejected := d.ejected()
+	if len(ejected) != 2 || !ejected[infos[0].sc] || !ejected[infos[1].sc] {
+		t.Fatalf("ejected %d of %d subconns, want the first 2 (50%%)", len(ejected), len(infos))
+	}
+}
+
+func TestOutlierSuccessRate(t *testing.T) {
+	infos := testInfos(1, 1, 1, 1, 1)
+	d := newOutlierDetector()
+	d.update(infos, OutlierConfig{Interval: 20, ConsecutiveFailures: 1000, MaxEjectionPercent: 100})
+
+	// 成功率为0的实例低于平均值0.8减去1.9倍标准差0.4
+	for _, info := range infos[:4] {
+		recordN(d, info, 10, nil)
+	}
+	recordN(d, infos[4], 10, errBackend)
+
+	// 统计周期结束前不检测
+	d.check()
+	if len(d.ejected()) != 0 {
+		t.Fatalf("ejected = %v before interval", d.ejected())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	d.check()
+
+	ejected := d.ejected()
+	if len(ejected) != 1 || !ejected[infos[4].sc] {
+		t.Fatalf("ejected = %v, want %s", ejected, infos[4].id)
+	}
+}
+
+func TestOutlierSuccessRateMinHosts(t *testing.T) {
+	infos := testInfos(1, 1, 1)
+	d := newOutlierDetector()
+	d.update(infos, OutlierConfig{Interval: 20, ConsecutiveFailures: 1000, MaxEjectionPercent: 100})
+
+	// 请求量不足的实例不参与检测，参与的实例少于3个时不按成功率摘除
+	recordN(d, infos[0], 10, nil)
+	recordN(d, infos[1], 10, errBackend)
+	recordN(d, infos[2], 5, nil)
+
+	time.Sleep(30 * time.Millisecond)
+	d.check()
+
+	if len(d.ejected()) != 0 {
+		t.Fatalf("ejected = %v with too few hosts", d.ejected())
+	}
+}
@@ -0,0 +1,279 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zjmnssy/serviceRD/service"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+// errPickRejected selector选中的连接被熔断器拒绝，请求并未发出，selector不应将其计入统计
+var errPickRejected = errors.New("pick rejected by circuit breaker")
+
+// subConnInfo 可用连接及其实例信息
+type subConnInfo struct {
+	sc         balancer.SubConn
+	addr       resolver.Address
+	serverType string
+	id         string // 服务ID，没有时使用地址
+	weight     int
+	version    string
+	region     string
+	zone       string
+}
+
+// newSubConnInfos 从地址的Metadata中解析权重和版本，权重无效时为1，权重为0的实例不分配流量
+func newSubConnInfos(readySCs map[resolver.Address]balancer.SubConn) []subConnInfo {
+	infos := make([]subConnInfo, 0, len(readySCs))
+
+	for addr, sc := range readySCs {
+		info := newSubConnInfo(addr, sc)
+		if info.weight == 0 {
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+// newSubConnInfo 地域和可用区优先从Attributes中获取
+func newSubConnInfo(addr resolver.Address, sc balancer.SubConn) subConnInfo {
+	info := subConnInfo{sc: sc, addr: addr, weight: 1}
+
+	if addr.Metadata != nil {
+		if m, ok := addr.Metadata.(*map[string]string); ok {
+			w, ok := (*m)["weight"]
+			if ok {
+				n, err := strconv.Atoi(w)
+				if err == nil && n >= 0 {
+					info.weight = n
+				}
+			}
+
+			info.serverType = (*m)["serverType"]
+			info.id = (*m)["serverID"]
+			info.version = (*m)["version"]
+			info.region = (*m)["region"]
+			info.zone = (*m)["zone"]
+		}
+	}
+
+	if info.id == "" {
+		info.id = addr.Addr
+	}
+
+	if addr.Attributes != nil {
+		if region, ok := addr.Attributes.Value(service.AttrRegion).(string); ok {
+			info.region = region
+		}
+		if zone, ok := addr.Attributes.Value(service.AttrZone).(string); ok {
+			info.zone = zone
+		}
+	}
+
+	return info
+}
+
+func (info subConnInfo) breakerKey() string {
+	return breakerKey(info.serverType, info.id)
+}
+
+// selector 在一组连接中选择一个，由picker加锁调用，ctx为本次调用的context，done在调用结束时回调，可以为nil，
+// 没有可以选择的连接时返回nil
+type selector interface {
+	pick(ctx context.Context) (balancer.SubConn, func(balancer.DoneInfo))
+}
+
+// versionPicker 按版本约束过滤连接后交给selector选择，每种约束的selector只创建一次，
+// 被异常检测摘除或熔断的连接不参与选择，本picker使用的连接摘除、熔断状态变化或熔断到期时重新创建selector
+type versionPicker struct {
+	infos       []subConnInfo
+	keys        map[balancer.SubConn]string // 熔断器的key
+	version     VersionConstraint           // 服务配置中的约束
+	holder      *configHolder
+	newSelector func(infos []subConnInfo, c VersionConstraint) selector // c为本次选择使用的版本约束
+
+	mu         sync.Mutex
+	outlierSeq int64
+	breakerSeq int64
+	reopenAt   time.Time // 最早的熔断到期时间，到期后重新创建selector使其参与半开探测
+	selectors  map[string]*versionPick
+}
+
+// versionPick 某种约束的selector，fallback不包含半开状态的连接，在半开连接探测数已满时使用
+type versionPick struct {
+	s        selector
+	fallback selector
+	err      error
+}
+
+func newVersionPicker(infos []subConnInfo, h *configHolder, newSelector func(infos []subConnInfo) selector) *versionPicker {
+	return newConstraintPicker(infos, h, func(infos []subConnInfo, c VersionConstraint) selector {
+		return newSelector(infos)
+	})
+}
+
+// newConstraintPicker selector需要结合版本约束处理候选以外的实例时使用
+func newConstraintPicker(infos []subConnInfo, h *configHolder, newSelector func(infos []subConnInfo, c VersionConstraint) selector) *versionPicker {
+	config := h.get()
+	h.outlier.update(infos, config.Outlier)
+	h.useBreakers(infos, config.Breaker)
+
+	keys := make(map[balancer.SubConn]string, len(infos))
+	for _, info := range infos {
+		keys[info.sc] = info.breakerKey()
+	}
+
+	return &versionPicker{
+		infos:       infos,
+		keys:        keys,
+		version:     config.Version,
+		holder:      h,
+		newSelector: newSelector,
+		outlierSeq:  -1,
+		breakerSeq:  -1,
+		selectors:   make(map[string]*versionPick),
+	}
+}
+
+func (p *versionPicker) Pick(ctx context.Context, opt balancer.PickInfo) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	c := p.version
+	if v, ok := versionFromContext(ctx); ok {
+		c = v
+	}
+
+	key := c.String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	outlierSeq, breakerSeq := p.holder.outlier.check(), atomic.LoadInt64(&p.holder.breakerSeq)
+	expired := !p.reopenAt.IsZero() && !time.Now().Before(p.reopenAt)
+	if outlierSeq != p.outlierSeq || breakerSeq != p.breakerSeq || expired {
+		p.outlierSeq, p.breakerSeq = outlierSeq, breakerSeq
+		p.reopenAt = time.Time{}
+		p.selectors = make(map[string]*versionPick)
+	}
+
+	vp, ok := p.selectors[key]
+	if !ok {
+		vp = p.build(c)
+		p.selectors[key] = vp
+	}
+
+	if vp.err != nil {
+		return nil, nil, vp.err
+	}
+
+	// 选中的半开连接探测数已满时，改为在不包含半开连接的范围内选择
+	for _, s := range []selector{vp.s, vp.fallback} {
+		if s == nil {
+			continue
+		}
+
+		sc, done := s.pick(ctx)
+		if sc == nil {
+			return nil, nil, status.Errorf(codes.Unavailable, "no instance selected for version constraint %s", c)
+		}
+
+		id := p.keys[sc]
+		allowed, probe := breakers.allow(id)
+		if !allowed {
+			if done != nil {
+				done(balancer.DoneInfo{Err: errPickRejected})
+			}
+			continue
+		}
+
+		return sc, func(info balancer.DoneInfo) {
+			if done != nil {
+				done(info)
+			}
+			p.holder.outlier.record(sc, info.Err)
+			breakers.record(id, probe, info.Err)
+		}, nil
+	}
+
+	return nil, nil, status.Errorf(codes.Unavailable, "circuit breakers of all instances matching version constraint %s are open or probing", c)
+}
+
+// build 生成满足约束的selector，优先使用未被摘除的连接，满足约束的连接都被摘除时仍然使用它们，熔断的连接不使用
+func (p *versionPicker) build(c VersionConstraint) *versionPick {
+	usable := make([]subConnInfo, 0, len(p.infos))
+	halfOpen := make(map[balancer.SubConn]bool)
+
+	for _, info := range p.infos {
+		state, reopenAt := breakers.state(p.keys[info.sc])
+		switch state {
+		case CircuitOpen:
+			{
+				if p.reopenAt.IsZero() || reopenAt.Before(p.reopenAt) {
+					p.reopenAt = reopenAt
+				}
+				continue
+			}
+		case CircuitHalfOpen:
+			{
+				halfOpen[info.sc] = true
+			}
+		}
+
+		usable = append(usable, info)
+	}
+
+	candidates := filterVersion(p.healthy(usable), c)
+	if len(candidates) == 0 {
+		candidates = filterVersion(usable, c)
+	}
+
+	if len(candidates) == 0 {
+		if len(filterVersion(p.infos, c)) == 0 {
+			return &versionPick{err: status.Errorf(codes.Unavailable, "no available instance matches version constraint %s", c)}
+		}
+
+		return &versionPick{err: status.Errorf(codes.Unavailable, "circuit breakers of all instances matching version constraint %s are open", c)}
+	}
+
+	vp := &versionPick{s: p.newSelector(candidates, c)}
+
+	if len(halfOpen) > 0 {
+		closed := make([]subConnInfo, 0, len(candidates))
+		for _, info := range candidates {
+			if !halfOpen[info.sc] {
+				closed = append(closed, info)
+			}
+		}
+
+		if len(closed) > 0 && len(closed) < len(candidates) {
+			vp.fallback = p.newSelector(closed, c)
+		}
+	}
+
+	return vp
+}
+
+// healthy 未被摘除的连接
+func (p *versionPicker) healthy(infos []subConnInfo) []subConnInfo {
+	ejected := p.holder.outlier.ejected()
+	if len(ejected) == 0 {
+		return infos
+	}
+
+	result := make([]subConnInfo, 0, len(infos))
+	for _, info := range infos {
+		if !ejected[info.sc] {
+			result = append(result, info)
+		}
+	}
+
+	return result
+}
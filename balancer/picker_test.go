@@ -0,0 +1,27 @@
+package balancer
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// fakeSubConn 测试用连接，用名称区分
+type fakeSubConn struct {
+	name string
+}
+
+func (sc *fakeSubConn) UpdateAddresses([]resolver.Address) {}
+
+func (sc *fakeSubConn) Connect() {}
+
+// testInfos 按权重生成连接，名称为sc0、sc1...
+func testInfos(weights ...int) []subConnInfo {
+	infos := make([]subConnInfo, 0, len(weights))
+	for i, w := range weights {
+		name := fmt.Sprintf("sc%d", i)
+		infos = append(infos, subConnInfo{sc: &fakeSubConn{name: name}, id: name, weight: w})
+	}
+
+	return infos
+}
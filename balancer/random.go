@@ -3,8 +3,6 @@ package balancer
 import (
 	"context"
 	"math/rand"
-	"strconv"
-	"sync"
 
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
@@ -15,7 +13,9 @@ import (
 const Random = "random-my"
 
 func newRandomBuilder() balancer.Builder {
-	return base.NewBalancerBuilderWithConfig(Random, &randomPickerBuilder{}, base.Config{HealthCheck: true})
+	return newConfigBuilder(Random, func(h *configHolder) base.PickerBuilder {
+		return &randomPickerBuilder{holder: h}
+	})
 }
 
 // 注意：需要在包初始化的时候注册到grpc中
@@ -24,49 +24,86 @@ func init() {
 }
 
 type randomPickerBuilder struct {
+	holder *configHolder
 }
 
-// Build 支持权重，权重的实现为：按权重值，向队列中增加权重数量的实例
-func (*randomPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+// Build 支持权重和版本约束
+func (b *randomPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
 	if len(readySCs) == 0 {
 		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
 	}
 
-	var scs []balancer.SubConn
-
-	for addr, sc := range readySCs {
-		weight := 1
-
-		if addr.Metadata != nil {
-			m, ok := addr.Metadata.(*map[string]string)
-			if ok {
-				w, ok := (*m)["weight"]
-				if ok {
-					n, err := strconv.Atoi(w)
-					if err == nil && n > 0 {
-						weight = n
-					}
-				}
-			}
+	return newVersionPicker(newSubConnInfos(readySCs), b.holder, newRandomSelector)
+}
+
+// randomSelector 别名法加权随机：将各实例的概率拆分到等宽的桶中，每个桶最多属于两个实例，
+// 选择时随机一个桶再按桶内比例选择，时间O(1)，内存只与实例数有关
+type randomSelector struct {
+	subConns []balancer.SubConn
+	prob     []float64 // 桶内选择本实例的概率
+	alias    []int     // 桶内另一个实例的下标
+}
+
+func newRandomSelector(infos []subConnInfo) selector {
+	n := len(infos)
+	s := &randomSelector{
+		subConns: make([]balancer.SubConn, n),
+		prob:     make([]float64, n),
+		alias:    make([]int, n),
+	}
+
+	total := 0
+	for _, info := range infos {
+		total += info.weight
+	}
+
+	// 按实例数放大后，概率小于1的实例需要从概率大于1的实例借用
+	scaled := make([]float64, n)
+	small := make([]int, 0, n)
+	large := make([]int, 0, n)
+	for i, info := range infos {
+		s.subConns[i] = info.sc
+		scaled[i] = float64(info.weight) * float64(n) / float64(total)
+		if scaled[i] < 1 {
+			small = append(small, i)
+		} else {
+			large = append(large, i)
 		}
+	}
+
+	for len(small) > 0 && len(large) > 0 {
+		l := small[len(small)-1]
+		small = small[:len(small)-1]
+		g := large[len(large)-1]
+		large = large[:len(large)-1]
 
-		for i := 0; i < weight; i++ {
-			scs = append(scs, sc)
+		s.prob[l] = scaled[l]
+		s.alias[l] = g
+
+		scaled[g] = scaled[g] + scaled[l] - 1
+		if scaled[g] < 1 {
+			small = append(small, g)
+		} else {
+			large = append(large, g)
 		}
 	}
 
-	return &randomPicker{subConns: scs}
-}
+	// 剩余的桶只属于一个实例，浮点误差导致的剩余小概率实例同样处理
+	for _, i := range large {
+		s.prob[i] = 1
+	}
+	for _, i := range small {
+		s.prob[i] = 1
+	}
 
-type randomPicker struct {
-	subConns []balancer.SubConn
-	mu       sync.Mutex
+	return s
 }
 
-func (p *randomPicker) Pick(ctx context.Context, opt balancer.PickInfo) (balancer.SubConn, func(balancer.DoneInfo), error) {
-	p.mu.Lock()
-	sc := p.subConns[rand.Intn(len(p.subConns))]
-	p.mu.Unlock()
+func (s *randomSelector) pick(ctx context.Context) (balancer.SubConn, func(balancer.DoneInfo)) {
+	i := rand.Intn(len(s.subConns))
+	if rand.Float64() < s.prob[i] {
+		return s.subConns[i], nil
+	}
 
-	return sc, nil, nil
+	return s.subConns[s.alias[i]], nil
 }
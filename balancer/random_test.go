@@ -0,0 +1,124 @@
+package balancer
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"google.golang.org/grpc/balancer"
+)
+
+var randomWeightTables = [][]int{
+	{1},
+	{1, 1},
+	{1, 2, 3, 4},
+	{1000, 1},
+	{1, 1000},
+	{3, 3, 3},
+	{7, 0, 5},
+	{1, 1, 1, 1, 1, 1, 1, 97},
+	{100, 200, 300, 1, 1, 1, 1, 1, 1, 1, 1},
+}
+
+// aliasProbability 根据别名表计算每个连接被选中的精确概率
+func aliasProbability(s *randomSelector) map[balancer.SubConn]float64 {
+	n := float64(len(s.subConns))
+	p := make(map[balancer.SubConn]float64, len(s.subConns))
+
+	for i, sc := range s.subConns {
+		p[sc] += s.prob[i] / n
+		p[s.subConns[s.alias[i]]] += (1 - s.prob[i]) / n
+	}
+
+	return p
+}
+
+func TestRandomSelectorAliasTable(t *testing.T) {
+	for _, weights := range randomWeightTables {
+		infos := testInfos(weights...)
+		s := newRandomSelector(infos).(*randomSelector)
+
+		total := 0
+		for _, w := range weights {
+			total += w
+		}
+
+		for i := range s.subConns {
+			if s.alias[i] < 0 || s.alias[i] >= len(s.subConns) {
+				t.Fatalf("weights = %v, alias[%d] = %d out of range", weights, i, s.alias[i])
+			}
+			if s.prob[i] < 0 || s.prob[i] > 1 {
+				t.Fatalf("weights = %v, prob[%d] = %f out of range", weights, i, s.prob[i])
+			}
+		}
+
+		p := aliasProbability(s)
+		for _, info := range infos {
+			want := float64(info.weight) / float64(total)
+			if math.Abs(p[info.sc]-want) > 1e-9 {
+				t.Fatalf("weights = %v, probability of %s = %f, want %f", weights, info.id, p[info.sc], want)
+			}
+		}
+	}
+}
+
+func TestRandomSelectorFrequency(t *testing.T) {
+	const picks = 200000
+
+	for _, weights := range randomWeightTables {
+		infos := testInfos(weights...)
+		s := newRandomSelector(infos)
+
+		total := 0
+		for _, w := range weights {
+			total += w
+		}
+
+		counts := make(map[balancer.SubConn]int, len(infos))
+		for i := 0; i < picks; i++ {
+			sc, _ := s.pick(context.Background())
+			counts[sc]++
+		}
+
+		// 允许5个标准差的误差
+		for _, info := range infos {
+			p := float64(info.weight) / float64(total)
+			want := p * picks
+			tolerance := 5*math.Sqrt(picks*p*(1-p)) + 1
+			if math.Abs(float64(counts[info.sc])-want) > tolerance {
+				t.Fatalf("weights = %v, %s picked %d times, want %.0f ± %.0f", weights, info.id, counts[info.sc], want, tolerance)
+			}
+		}
+	}
+}
+
+// TestRandomSelectorRounding 浮点误差留下的桶只属于自身，不会选到范围外的连接
+func TestRandomSelectorRounding(t *testing.T) {
+	for n := 1; n <= 64; n++ {
+		weights := make([]int, n)
+		for i := range weights {
+			weights[i] = 1 + i*i*7919%1009
+		}
+
+		infos := testInfos(weights...)
+		s := newRandomSelector(infos).(*randomSelector)
+
+		known := make(map[balancer.SubConn]bool, n)
+		for _, info := range infos {
+			known[info.sc] = true
+		}
+
+		for i := 0; i < 1000; i++ {
+			sc, _ := s.pick(context.Background())
+			if !known[sc] {
+				t.Fatalf("weights = %v, picked unknown subconn %v", weights, sc)
+			}
+		}
+
+		for i := range s.subConns {
+			if s.prob[i] < 1 && s.alias[i] == i {
+				t.Fatalf("weights = %v, bucket %d aliases itself with prob %f", weights, i, s.prob[i])
+			}
+		}
+	}
+}
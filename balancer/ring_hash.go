@@ -0,0 +1,174 @@
+package balancer
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+)
+
+// RingHash 一致性hash负载均衡方式名称
+const RingHash = "ring_hash"
+
+// DefaultHashHeader 默认从此metadata中获取hash key
+const DefaultHashHeader = "x-hash-key"
+
+const (
+	ringReplicas = 100    // 每单位权重的虚拟节点数
+	ringMaxSize  = 100000 // 虚拟节点总数上限，超过时按比例缩减
+)
+
+func newRingHashBuilder() balancer.Builder {
+	return newConfigBuilder(RingHash, func(h *configHolder) base.PickerBuilder {
+		return &ringHashPickerBuilder{holder: h}
+	})
+}
+
+// 注意：需要在包初始化的时候注册到grpc中
+func init() {
+	balancer.Register(newRingHashBuilder())
+}
+
+type hashKey struct{}
+
+// WithHashKey 为单次调用指定hash key，优先于metadata中的hash key
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+// hashKeyFromContext 先从context中获取，再从outgoing metadata的header中获取
+func hashKeyFromContext(ctx context.Context, header string) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+
+	if key, ok := ctx.Value(hashKey{}).(string); ok {
+		return key, true
+	}
+
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		if values := md.Get(header); len(values) > 0 {
+			return values[0], true
+		}
+	}
+
+	return "", false
+}
+
+type ringHashPickerBuilder struct {
+	holder *configHolder
+}
+
+// Build 支持权重和版本约束
+func (b *ringHashPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	if len(readySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	config := b.holder.get()
+
+	header := config.HashHeader
+	if header == "" {
+		header = DefaultHashHeader
+	}
+
+	newSelector := func(infos []subConnInfo) selector {
+		return newRingHashSelector(infos, header)
+	}
+
+	return newVersionPicker(newSubConnInfos(readySCs), b.holder, newSelector)
+}
+
+// ringHashSelector hash环，虚拟节点按实例ID计算位置，实例增减时只有相邻区间的key改变归属
+type ringHashSelector struct {
+	header string
+	hashes []uint64 // 升序
+	nodes  []balancer.SubConn
+}
+
+type ringNode struct {
+	hash uint64
+	sc   balancer.SubConn
+}
+
+func newRingHashSelector(infos []subConnInfo, header string) selector {
+	total := 0
+	for _, info := range infos {
+		total += info.weight
+	}
+
+	// 虚拟节点数与权重成正比
+	scale := float64(ringReplicas)
+	if total*ringReplicas > ringMaxSize {
+		scale = float64(ringMaxSize) / float64(total)
+	}
+
+	ring := make([]ringNode, 0)
+	for _, info := range infos {
+		// 虚拟节点按服务ID计算位置，实例地址变化时位置不变
+		id := info.id
+
+		n := int(float64(info.weight)*scale + 0.5)
+		if n < 1 {
+			n = 1
+		}
+
+		for i := 0; i < n; i++ {
+			ring = append(ring, ringNode{hash: hashString(id + "_" + strconv.Itoa(i)), sc: info.sc})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	s := &ringHashSelector{
+		header: header,
+		hashes: make([]uint64, len(ring)),
+		nodes:  make([]balancer.SubConn, len(ring)),
+	}
+	for i, node := range ring {
+		s.hashes[i] = node.hash
+		s.nodes[i] = node.sc
+	}
+
+	return s
+}
+
+// pick 选择hash值之后的第一个虚拟节点，没有hash key时随机选择
+func (s *ringHashSelector) pick(ctx context.Context) (balancer.SubConn, func(balancer.DoneInfo)) {
+	var h uint64
+
+	key, ok := hashKeyFromContext(ctx, s.header)
+	if ok {
+		h = hashString(key)
+	} else {
+		h = rand.Uint64()
+	}
+
+	i := sort.Search(len(s.hashes), func(i int) bool { return s.hashes[i] >= h })
+	if i == len(s.hashes) {
+		i = 0
+	}
+
+	return s.nodes[i], nil
+}
+
+// hashString FNV-1a后再做一次混合，使相近的字符串在环上分布均匀
+func hashString(str string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(str))
+	h := f.Sum64()
+
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
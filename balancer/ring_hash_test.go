@@ -0,0 +1,77 @@
+package balancer
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+// ringPicks 每个key选中的连接名称
+func ringPicks(s selector, keys int) []string {
+	names := make([]string, keys)
+	for i := range names {
+		sc, _ := s.pick(WithHashKey(context.Background(), "key-"+strconv.Itoa(i)))
+		names[i] = sc.(*fakeSubConn).name
+	}
+
+	return names
+}
+
+func TestRingHashMinimalRemap(t *testing.T) {
+	const n, keys = 5, 20000
+
+	before := ringPicks(newRingHashSelector(testInfos(1, 1, 1, 1, 1), DefaultHashHeader), keys)
+	after := ringPicks(newRingHashSelector(testInfos(1, 1, 1, 1, 1, 1), DefaultHashHeader), keys)
+
+	// 增加一个实例时只有约1/(N+1)的key改变归属，且都归属新实例
+	moved := 0
+	for i := range before {
+		if before[i] == after[i] {
+			continue
+		}
+
+		moved++
+		if after[i] != "sc5" {
+			t.Fatalf("key-%d moved from %s to %s, want the new instance sc5", i, before[i], after[i])
+		}
+	}
+
+	ratio, want := float64(moved)/keys, 1.0/(n+1)
+	if ratio < want*0.7 || ratio > want*1.3 {
+		t.Fatalf("moved %.3f of keys, want about %.3f", ratio, want)
+	}
+}
+
+func TestRingHashNodesScaleWithWeight(t *testing.T) {
+	nodes := func(s selector) map[string]int {
+		count := make(map[string]int)
+		for _, sc := range s.(*ringHashSelector).nodes {
+			count[sc.(*fakeSubConn).name]++
+		}
+
+		return count
+	}
+
+	count := nodes(newRingHashSelector(testInfos(1, 3), DefaultHashHeader))
+	if count["sc0"] != ringReplicas || count["sc1"] != 3*ringReplicas {
+		t.Fatalf("nodes = %v, want %d and %d", count, ringReplicas, 3*ringReplicas)
+	}
+
+	// 超过上限时按比例缩减
+	count = nodes(newRingHashSelector(testInfos(500, 1500), DefaultHashHeader))
+	if count["sc0"]+count["sc1"] != ringMaxSize || count["sc1"] != 3*count["sc0"] {
+		t.Fatalf("nodes = %v, want %d in ratio 1:3", count, ringMaxSize)
+	}
+
+	// key的分布与权重成正比
+	picked := 0
+	for _, name := range ringPicks(newRingHashSelector(testInfos(1, 3), DefaultHashHeader), 20000) {
+		if name == "sc1" {
+			picked++
+		}
+	}
+
+	if ratio := float64(picked) / 20000; ratio < 0.65 || ratio > 0.85 {
+		t.Fatalf("sc1 picked %.3f of keys, want about 0.75", ratio)
+	}
+}
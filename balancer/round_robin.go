@@ -3,8 +3,6 @@ package balancer
 import (
 	"context"
 	"math/rand"
-	"strconv"
-	"sync"
 
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
@@ -15,7 +13,9 @@ import (
 const RoundRobin = "round_robin"
 
 func newRoundRobinBuilder() balancer.Builder {
-	return base.NewBalancerBuilderWithConfig(RoundRobin, &roundRobinPickerBuilder{}, base.Config{HealthCheck: true})
+	return newConfigBuilder(RoundRobin, func(h *configHolder) base.PickerBuilder {
+		return &roundRobinPickerBuilder{holder: h}
+	})
 }
 
 // 注意：需要在包初始化的时候注册到grpc中
@@ -23,52 +23,56 @@ func init() {
 	balancer.Register(newRoundRobinBuilder())
 }
 
-type roundRobinPickerBuilder struct{}
+type roundRobinPickerBuilder struct {
+	holder *configHolder
+}
 
-func (*roundRobinPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+// Build 支持权重和版本约束
+func (b *roundRobinPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
 	if len(readySCs) == 0 {
 		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
 	}
-	var scs []balancer.SubConn
-	for addr, sc := range readySCs {
-		// version filter
-
-		// weight
-		weight := 1
-		if addr.Metadata != nil {
-			if m, ok := addr.Metadata.(*map[string]string); ok {
-				w, ok := (*m)["weight"]
-				if ok {
-					n, err := strconv.Atoi(w)
-					if err == nil && n > 0 {
-						weight = n
-					}
-				}
-			}
-		}
 
-		for i := 0; i < weight; i++ {
-			scs = append(scs, sc)
-		}
-	}
+	return newVersionPicker(newSubConnInfos(readySCs), b.holder, newRoundRobinSelector)
+}
 
-	return &roundRobinPicker{
-		subConns: scs,
-		next:     rand.Intn(len(scs)),
-	}
+// roundRobinSelector 平滑加权轮询：每次选择时各实例的当前值加上自身权重，选择当前值最大的实例并减去总权重，
+// 权重大的实例被选中的次数多且与其他实例交错，内存只与实例数有关
+type roundRobinSelector struct {
+	items []wrrItem
+	total int
+}
+
+type wrrItem struct {
+	sc      balancer.SubConn
+	weight  int
+	current int
 }
 
-type roundRobinPicker struct {
-	subConns []balancer.SubConn
-	mu       sync.Mutex
-	next     int
+// newRoundRobinSelector 随机轮转实例顺序，避免所有客户端从同一个实例开始
+func newRoundRobinSelector(infos []subConnInfo) selector {
+	s := &roundRobinSelector{items: make([]wrrItem, 0, len(infos))}
+
+	offset := rand.Intn(len(infos))
+	for i := range infos {
+		info := infos[(i+offset)%len(infos)]
+		s.items = append(s.items, wrrItem{sc: info.sc, weight: info.weight})
+		s.total += info.weight
+	}
+
+	return s
 }
 
-func (p *roundRobinPicker) Pick(ctx context.Context, opt balancer.PickInfo) (balancer.SubConn, func(balancer.DoneInfo), error) {
-	p.mu.Lock()
-	sc := p.subConns[p.next]
-	p.next = (p.next + 1) % len(p.subConns)
-	p.mu.Unlock()
+func (s *roundRobinSelector) pick(ctx context.Context) (balancer.SubConn, func(balancer.DoneInfo)) {
+	best := -1
+	for i := range s.items {
+		s.items[i].current += s.items[i].weight
+		if best < 0 || s.items[i].current > s.items[best].current {
+			best = i
+		}
+	}
+
+	s.items[best].current -= s.total
 
-	return sc, nil, nil
+	return s.items[best].sc, nil
 }
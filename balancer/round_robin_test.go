@@ -0,0 +1,60 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/balancer"
+)
+
+func TestRoundRobinSelectorSequence(t *testing.T) {
+	infos := testInfos(5, 1, 1)
+
+	// 不经过newRoundRobinSelector，避免随机的起始位置
+	s := &roundRobinSelector{total: 7}
+	for _, info := range infos {
+		s.items = append(s.items, wrrItem{sc: info.sc, weight: info.weight})
+	}
+
+	want := []string{"sc0", "sc0", "sc1", "sc0", "sc2", "sc0", "sc0"}
+	for round := 0; round < 3; round++ {
+		for i, name := range want {
+			sc, _ := s.pick(context.Background())
+			if got := sc.(*fakeSubConn).name; got != name {
+				t.Fatalf("round %d pick %d = %s, want %s", round, i, got, name)
+			}
+		}
+	}
+}
+
+func TestRoundRobinSelectorWeights(t *testing.T) {
+	tables := [][]int{{5, 1, 1}, {1}, {3, 3}, {1000, 1}, {2, 3, 4, 0}}
+
+	for _, weights := range tables {
+		infos := make([]subConnInfo, 0, len(weights))
+		total := 0
+		for _, info := range testInfos(weights...) {
+			if info.weight > 0 {
+				infos = append(infos, info)
+				total += info.weight
+			}
+		}
+
+		s := newRoundRobinSelector(infos)
+
+		// 每个周期内各实例恰好被选中权重次
+		for round := 0; round < 3; round++ {
+			counts := make(map[balancer.SubConn]int, len(infos))
+			for i := 0; i < total; i++ {
+				sc, _ := s.pick(context.Background())
+				counts[sc]++
+			}
+
+			for _, info := range infos {
+				if counts[info.sc] != info.weight {
+					t.Fatalf("weights = %v, round %d, %s picked %d times, want %d", weights, round, info.id, counts[info.sc], info.weight)
+				}
+			}
+		}
+	}
+}
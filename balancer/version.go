@@ -0,0 +1,221 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// VersionConstraint 版本约束，版本格式为年月日＋三位序号，如20190828001，
+// Exact、Min/Max、Latest同时设置时需全部满足，零值表示不限制版本
+type VersionConstraint struct {
+	Exact  string `json:"exact,omitempty"`  // 指定版本
+	Min    string `json:"min,omitempty"`    // 最低版本，包含
+	Max    string `json:"max,omitempty"`    // 最高版本，包含
+	Latest int    `json:"latest,omitempty"` // 只使用最新的N个版本
+}
+
+// ExactVersion 只使用指定版本的实例
+func ExactVersion(version string) VersionConstraint {
+	return VersionConstraint{Exact: version}
+}
+
+// MinVersion 只使用不低于指定版本的实例
+func MinVersion(version string) VersionConstraint {
+	return VersionConstraint{Min: version}
+}
+
+// VersionRange 只使用版本在[min, max]之间的实例，为空表示不限制
+func VersionRange(min string, max string) VersionConstraint {
+	return VersionConstraint{Min: min, Max: max}
+}
+
+// LatestVersions 只使用最新的n个版本的实例
+func LatestVersions(n int) VersionConstraint {
+	return VersionConstraint{Latest: n}
+}
+
+// IsZero 是否没有任何限制
+func (c VersionConstraint) IsZero() bool {
+	return c == VersionConstraint{}
+}
+
+// String 约束的文本形式，同时用作缓存的key
+func (c VersionConstraint) String() string {
+	return fmt.Sprintf("exact=%s,min=%s,max=%s,latest=%d", c.Exact, c.Min, c.Max, c.Latest)
+}
+
+// validate 检查约束中的版本格式
+func (c VersionConstraint) validate() error {
+	for _, v := range []string{c.Exact, c.Min, c.Max} {
+		if v == "" {
+			continue
+		}
+
+		if _, _, ok := parseVersion(v); !ok {
+			return fmt.Errorf("version = %s error, want yyyymmdd and 3-digit sequence", v)
+		}
+	}
+
+	if c.Latest < 0 {
+		return fmt.Errorf("latest = %d error", c.Latest)
+	}
+
+	if c.Min != "" && c.Max != "" && CompareVersion(c.Min, c.Max) > 0 {
+		return fmt.Errorf("min version %s greater than max version %s", c.Min, c.Max)
+	}
+
+	return nil
+}
+
+// match 单个版本是否满足Exact、Min、Max限制，Latest需结合所有版本判断
+func (c VersionConstraint) match(version string) bool {
+	if version == "" {
+		return false
+	}
+
+	if c.Exact != "" && CompareVersion(version, c.Exact) != 0 {
+		return false
+	}
+
+	if c.Min != "" && CompareVersion(version, c.Min) < 0 {
+		return false
+	}
+
+	if c.Max != "" && CompareVersion(version, c.Max) > 0 {
+		return false
+	}
+
+	return true
+}
+
+// parseVersion 解析年月日＋序号格式的版本
+func parseVersion(version string) (date int64, seq int64, ok bool) {
+	if len(version) < 9 {
+		return 0, 0, false
+	}
+
+	date, err := strconv.ParseInt(version[:8], 10, 64)
+	if err != nil || date < 0 {
+		return 0, 0, false
+	}
+
+	seq, err = strconv.ParseInt(version[8:], 10, 64)
+	if err != nil || seq < 0 {
+		return 0, 0, false
+	}
+
+	return date, seq, true
+}
+
+// CompareVersion 比较两个版本，先比较日期再比较序号，格式不正确的版本小于格式正确的版本，
+// 都不正确时按字符串比较，a < b 返回-1，a == b 返回0，a > b 返回1
+func CompareVersion(a string, b string) int {
+	dateA, seqA, okA := parseVersion(a)
+	dateB, seqB, okB := parseVersion(b)
+
+	switch {
+	case okA && okB:
+		{
+			if dateA != dateB {
+				return compareInt(dateA, dateB)
+			}
+
+			return compareInt(seqA, seqB)
+		}
+	case okA:
+		{
+			return 1
+		}
+	case okB:
+		{
+			return -1
+		}
+	default:
+		{
+			if a < b {
+				return -1
+			} else if a > b {
+				return 1
+			}
+
+			return 0
+		}
+	}
+}
+
+func compareInt(a int64, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+
+	return 0
+}
+
+// filterVersion 过滤出满足约束的实例
+func filterVersion(infos []subConnInfo, c VersionConstraint) []subConnInfo {
+	if c.IsZero() {
+		return infos
+	}
+
+	result := make([]subConnInfo, 0, len(infos))
+	for _, info := range infos {
+		if c.match(info.version) {
+			result = append(result, info)
+		}
+	}
+
+	if c.Latest <= 0 {
+		return result
+	}
+
+	versions := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, info := range result {
+		if !seen[info.version] {
+			seen[info.version] = true
+			versions = append(versions, info.version)
+		}
+	}
+
+	if len(versions) <= c.Latest {
+		return result
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return CompareVersion(versions[i], versions[j]) > 0 })
+
+	latest := make(map[string]bool, c.Latest)
+	for _, v := range versions[:c.Latest] {
+		latest[v] = true
+	}
+
+	filtered := make([]subConnInfo, 0, len(result))
+	for _, info := range result {
+		if latest[info.version] {
+			filtered = append(filtered, info)
+		}
+	}
+
+	return filtered
+}
+
+type versionKey struct{}
+
+// WithVersion 为单次调用指定版本约束，优先于服务配置中的约束
+func WithVersion(ctx context.Context, c VersionConstraint) context.Context {
+	return context.WithValue(ctx, versionKey{}, c)
+}
+
+// versionFromContext 获取单次调用指定的版本约束
+func versionFromContext(ctx context.Context) (VersionConstraint, bool) {
+	if ctx == nil {
+		return VersionConstraint{}, false
+	}
+
+	c, ok := ctx.Value(versionKey{}).(VersionConstraint)
+
+	return c, ok
+}
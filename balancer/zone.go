@@ -0,0 +1,156 @@
+package balancer
+
+import (
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// ZoneAware 优先本地可用区的负载均衡方式名称
+const ZoneAware = "zone_aware"
+
+// defaultSpillThreshold 默认溢出阈值
+const defaultSpillThreshold = 0.5
+
+// LocalityConfig 客户端所在位置，为空时使用SetLocality设置的位置
+type LocalityConfig struct {
+	Region    string  `json:"region,omitempty"`    // 地域
+	Zone      string  `json:"zone,omitempty"`      // 可用区
+	Threshold float64 `json:"threshold,omitempty"` // 本地已就绪实例的权重占本地全部实例权重的比例低于此值时，流量溢出到更大范围，为0时使用0.5
+}
+
+func (c LocalityConfig) validate() error {
+	if c.Threshold < 0 || c.Threshold > 1 {
+		return fmt.Errorf("locality threshold = %v error, want [0, 1]", c.Threshold)
+	}
+
+	return nil
+}
+
+var localityLock sync.Mutex
+var locality LocalityConfig
+
+// SetLocality 设置客户端默认所在的地域和可用区，服务配置中指定了位置时以服务配置为准
+func SetLocality(region string, zone string) {
+	localityLock.Lock()
+	locality = LocalityConfig{Region: region, Zone: zone}
+	localityLock.Unlock()
+}
+
+// withDefault 补全未配置的位置和阈值
+func (c LocalityConfig) withDefault() LocalityConfig {
+	if c.Region == "" && c.Zone == "" {
+		localityLock.Lock()
+		c.Region, c.Zone = locality.Region, locality.Zone
+		localityLock.Unlock()
+	}
+
+	if c.Threshold == 0 {
+		c.Threshold = defaultSpillThreshold
+	}
+
+	return c
+}
+
+func newZoneAwareBuilder() balancer.Builder {
+	return newConfigBuilder(ZoneAware, func(h *configHolder) base.PickerBuilder {
+		return &zoneAwarePickerBuilder{holder: h}
+	})
+}
+
+// 注意：需要在包初始化的时候注册到grpc中
+func init() {
+	balancer.Register(newZoneAwareBuilder())
+}
+
+type zoneAwarePickerBuilder struct {
+	holder *configHolder
+}
+
+// Build 依次检查本可用区、本地域的容量，选出第一个容量足够的范围，支持权重和版本约束，
+// 容量按参与选择的实例计算，被异常检测摘除或熔断的实例不计入，不满足版本约束的实例既不计入已就绪也不计入全部
+func (b *zoneAwarePickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	if len(readySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	config := b.holder.get()
+	loc := config.Locality.withDefault()
+
+	all := make([]subConnInfo, 0)
+	for _, addr := range b.holder.addresses() {
+		all = append(all, newSubConnInfo(addr, nil))
+	}
+
+	newSelector := func(candidates []subConnInfo, c VersionConstraint) selector {
+		matched := filterVersion(all, c)
+
+		for _, scope := range loc.scopes() {
+			if !hasCapacity(candidates, matched, scope, loc.Threshold) {
+				continue
+			}
+
+			local := make([]subConnInfo, 0, len(candidates))
+			for _, info := range candidates {
+				if scope(info) {
+					local = append(local, info)
+				}
+			}
+
+			return newRoundRobinSelector(local)
+		}
+
+		return newRoundRobinSelector(candidates)
+	}
+
+	return newConstraintPicker(newSubConnInfos(readySCs), b.holder, newSelector)
+}
+
+// scopes 由小到大的本地范围：本可用区、本地域，未设置的位置不参与
+func (c LocalityConfig) scopes() []func(info subConnInfo) bool {
+	scopes := make([]func(info subConnInfo) bool, 0, 2)
+
+	if c.Zone != "" {
+		scopes = append(scopes, func(info subConnInfo) bool {
+			return info.zone == c.Zone && (c.Region == "" || info.region == "" || info.region == c.Region)
+		})
+	}
+
+	if c.Region != "" {
+		scopes = append(scopes, func(info subConnInfo) bool {
+			return info.region == c.Region
+		})
+	}
+
+	return scopes
+}
+
+// hasCapacity 范围内已就绪实例的权重占范围内全部实例权重的比例是否达到阈值
+func hasCapacity(ready []subConnInfo, all []subConnInfo, scope func(info subConnInfo) bool, threshold float64) bool {
+	readyWeight, totalWeight := 0, 0
+
+	for _, info := range ready {
+		if scope(info) {
+			readyWeight += info.weight
+		}
+	}
+
+	for _, info := range all {
+		if scope(info) {
+			totalWeight += info.weight
+		}
+	}
+
+	if readyWeight == 0 {
+		return false
+	}
+
+	if totalWeight < readyWeight {
+		totalWeight = readyWeight
+	}
+
+	return float64(readyWeight) >= float64(totalWeight)*threshold
+}
@@ -0,0 +1,311 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zjmnssy/serviceRD/internal/backoff"
+	"github.com/zjmnssy/serviceRD/service"
+	"github.com/zjmnssy/zlog"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+const (
+	defaultLoadTimeout = 2000  // per - Millisecond
+	defaultBackoffBase = 500   // per - Millisecond
+	defaultBackoffMax  = 10000 // per - Millisecond
+)
+
+const (
+	keyCA     = "ca"
+	keyCert   = "cert"
+	keyKey    = "key"
+	keyWeight = "weight"
+)
+
+// Common 同类服务共用的配置，对应 /services/pull/serviceType/common
+type Common struct {
+	CA   string
+	Cert string
+	Key  string
+}
+
+// NoWeight 未配置权重
+const NoWeight = -1
+
+// Instance 服务实例自己的配置，对应 /services/pull/serviceType/serviceID
+type Instance struct {
+	Weight int // NoWeight表示未配置，0表示不分配流量
+}
+
+// Handler 配置变更回调，初始加载和监控到变化时都会调用，未设置的回调忽略
+type Handler struct {
+	OnCommon func(old Common, new Common) // ca、cert、key任一变化
+	OnWeight func(old int, new int)       // 本实例权重变化，未配置时为NoWeight
+}
+
+// Client 配置监控器使用的etcd接口，由*clientv3.Client实现
+type Client interface {
+	Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error)
+	Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan
+}
+
+// Watcher 服务配置监控器，加载并监控/services/pull下的共用配置和实例配置
+type Watcher struct {
+	client      Client
+	serviceType string
+	serviceID   string
+	handler     Handler
+
+	pullPrefix     string // 共用配置和实例配置所在的目录，一次加载、一个监控
+	commonPrefix   string
+	instancePrefix string
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	lock      sync.RWMutex
+	common    Common
+	instance  Instance
+	stopCh    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWatcher 创建服务配置监控器实例，服务类型和服务ID从desc的注册路径中解析
+func NewWatcher(client Client, desc service.Desc, handler Handler) (*Watcher, error) {
+	return NewWatcherWithLayout(client, service.DefaultLayout, desc, handler)
+}
+
+// NewWatcherWithLayout 创建使用指定目录布局的服务配置监控器实例
+func NewWatcherWithLayout(client Client, layout service.KeyLayout, desc service.Desc, handler Handler) (*Watcher, error) {
+	for k := range desc.GetServiceRegisterInfo() {
+		serviceType, serviceID, ok := layout.ParsePushKey(k)
+		if ok {
+			return newWatcher(client, layout, serviceType, serviceID, handler), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no push key found in service desc")
+}
+
+func newWatcher(client Client, layout service.KeyLayout, serviceType string, serviceID string, handler Handler) *Watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := &Watcher{
+		client:         client,
+		serviceType:    serviceType,
+		serviceID:      serviceID,
+		handler:        handler,
+		pullPrefix:     layout.PullPrefix(serviceType),
+		commonPrefix:   layout.PullCommonPrefix(serviceType),
+		instancePrefix: layout.PullInstancePrefix(serviceType, serviceID),
+		ctx:            ctx,
+		cancel:         cancel,
+		instance:       Instance{Weight: NoWeight},
+		stopCh:         make(chan struct{}),
+	}
+
+	return w
+}
+
+// Common 获取当前共用配置
+func (w *Watcher) Common() Common {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	return w.common
+}
+
+// Instance 获取当前实例配置
+func (w *Watcher) Instance() Instance {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	return w.instance
+}
+
+// Load 加载共用配置和实例配置
+func (w *Watcher) Load() error {
+	_, err := w.load()
+
+	return err
+}
+
+// load 在同一revision上加载共用配置和实例配置，返回加载时的revision
+func (w *Watcher) load() (int64, error) {
+	ctxNow, cancel := context.WithTimeout(w.ctx, time.Duration(defaultLoadTimeout)*time.Millisecond)
+	defer cancel()
+
+	resp, err := w.client.Get(ctxNow, w.pullPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	var common Common
+	instance := Instance{Weight: NoWeight}
+
+	for _, kv := range resp.Kvs {
+		w.set(&common, &instance, string(kv.Key), string(kv.Value))
+	}
+
+	w.update(common, instance)
+
+	return resp.Header.Revision, nil
+}
+
+// Run 启动监控器，在某一revision上加载后从revision+1开始监控，加载和监控之间的变化不丢失也不重复
+func (w *Watcher) Run() error {
+	revision, err := w.load()
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	go w.run(revision)
+
+	return nil
+}
+
+// Close 关闭监控器
+func (w *Watcher) Close() {
+	w.closeOnce.Do(func() {
+		close(w.stopCh)
+		w.cancel()
+	})
+}
+
+// run 监控中断时从最后的revision继续，revision已被压缩时重新加载，失败时退避重试
+func (w *Watcher) run(revision int64) {
+	retries := 0
+
+	for {
+		next, relist := w.watch(revision)
+		if next > revision {
+			revision = next
+			retries = 0
+		}
+
+		select {
+		case <-time.After(backoff.Duration(time.Duration(defaultBackoffBase)*time.Millisecond, time.Duration(defaultBackoffMax)*time.Millisecond, retries)):
+			{
+				retries++
+			}
+		case <-w.stopCh:
+			{
+				return
+			}
+		}
+
+		if relist {
+			rev, err := w.load()
+			if err != nil {
+				zlog.Prints(zlog.Warn, "config", "load %s error = %s", w.pullPrefix, err)
+				continue
+			}
+			revision = rev
+		}
+	}
+}
+
+// watch 从revision+1开始监控，返回已处理到的revision，relist为true时需要重新加载
+func (w *Watcher) watch(revision int64) (int64, bool) {
+	ctx, cancel := context.WithCancel(w.ctx)
+	defer cancel()
+
+	wch := w.client.Watch(ctx, w.pullPrefix, clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+
+	for {
+		select {
+		case resp, ok := <-wch:
+			{
+				if !ok {
+					zlog.Prints(zlog.Warn, "config", "watch %s closed, resume from revision %d", w.pullPrefix, revision)
+					return revision, false
+				}
+
+				if resp.CompactRevision != 0 || resp.Err() == rpctypes.ErrCompacted {
+					zlog.Prints(zlog.Warn, "config", "revision %d of %s compacted, reload", revision, w.pullPrefix)
+					return revision, true
+				}
+
+				if resp.Canceled || resp.Err() != nil {
+					zlog.Prints(zlog.Warn, "config", "watch %s canceled, error = %v", w.pullPrefix, resp.Err())
+					return revision, false
+				}
+
+				w.lock.RLock()
+				common, instance := w.common, w.instance
+				w.lock.RUnlock()
+
+				for _, ev := range resp.Events {
+					if ev.Type == clientv3.EventTypeDelete {
+						w.set(&common, &instance, string(ev.Kv.Key), "")
+					} else {
+						w.set(&common, &instance, string(ev.Kv.Key), string(ev.Kv.Value))
+					}
+					revision = ev.Kv.ModRevision
+				}
+
+				w.update(common, instance)
+			}
+		case <-w.stopCh:
+			{
+				return revision, false
+			}
+		}
+	}
+}
+
+func (w *Watcher) set(common *Common, instance *Instance, key string, value string) {
+	switch {
+	case strings.HasPrefix(key, w.commonPrefix):
+		{
+			switch strings.TrimPrefix(key, w.commonPrefix) {
+			case keyCA:
+				common.CA = value
+			case keyCert:
+				common.Cert = value
+			case keyKey:
+				common.Key = value
+			}
+		}
+	case strings.HasPrefix(key, w.instancePrefix):
+		{
+			if strings.TrimPrefix(key, w.instancePrefix) != keyWeight {
+				return
+			}
+
+			if value == "" {
+				instance.Weight = NoWeight
+				return
+			}
+
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				zlog.Prints(zlog.Warn, "config", "invalid weight key = %s, value = %s", key, value)
+				return
+			}
+
+			instance.Weight = n
+		}
+	}
+}
+
+func (w *Watcher) update(common Common, instance Instance) {
+	w.lock.Lock()
+	oldCommon, oldInstance := w.common, w.instance
+	w.common, w.instance = common, instance
+	w.lock.Unlock()
+
+	if oldCommon != common && w.handler.OnCommon != nil {
+		w.handler.OnCommon(oldCommon, common)
+	}
+
+	if oldInstance.Weight != instance.Weight && w.handler.OnWeight != nil {
+		w.handler.OnWeight(oldInstance.Weight, instance.Weight)
+	}
+}
@@ -0,0 +1,111 @@
+package detector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zjmnssy/serviceRD/service"
+)
+
+// cacheVersion 本地缓存文件的格式版本，格式不兼容时递增
+const cacheVersion = 2
+
+// cacheFile 本地缓存文件内容
+type cacheFile struct {
+	Version   int                         `json:"version"`
+	Prefix    string                      `json:"prefix"`
+	Revision  int64                       `json:"revision"`
+	SavedAt   time.Time                   `json:"savedAt"`
+	Instances map[string]service.Instance `json:"instances"` // key为注册路径
+}
+
+// fileCache 将各监控目录最近一次的实例列表保存在本地，etcd不可用时用于启动
+type fileCache struct {
+	dir string
+}
+
+func newFileCache(dir string) *fileCache {
+	return &fileCache{dir: dir}
+}
+
+// path 监控目录对应的缓存文件路径
+func (c *fileCache) path(prefix string) string {
+	name := strings.Trim(prefix, "/")
+	name = strings.Replace(name, "/", "_", -1)
+	if name == "" {
+		name = "_"
+	}
+
+	return filepath.Join(c.dir, name+".json")
+}
+
+// save 先写临时文件再重命名，保证缓存文件始终完整
+func (c *fileCache) save(prefix string, instances map[string]service.Instance, revision int64) error {
+	bytes, err := json.Marshal(cacheFile{
+		Version:   cacheVersion,
+		Prefix:    prefix,
+		Revision:  revision,
+		SavedAt:   time.Now(),
+		Instances: instances,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(c.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, ".cache-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(bytes)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.path(prefix))
+}
+
+// load 读取监控目录的缓存，版本或目录不匹配时返回错误
+func (c *fileCache) load(prefix string) (map[string]service.Instance, int64, error) {
+	bytes, err := ioutil.ReadFile(c.path(prefix))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var f cacheFile
+	err = json.Unmarshal(bytes, &f)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if f.Version != cacheVersion {
+		return nil, 0, fmt.Errorf("cache version = %d not supported", f.Version)
+	}
+
+	if f.Prefix != prefix {
+		return nil, 0, fmt.Errorf("cache prefix = %s, want %s", f.Prefix, prefix)
+	}
+
+	if f.Instances == nil {
+		f.Instances = make(map[string]service.Instance)
+	}
+
+	return f.Instances, f.Revision, nil
+}
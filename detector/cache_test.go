@@ -0,0 +1,130 @@
+package detector
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zjmnssy/serviceRD/service"
+)
+
+func tempCache(t *testing.T) (*fileCache, string) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "detector-cache-")
+	if err != nil {
+		t.Fatalf("create temp dir error = %s", err)
+	}
+
+	return newFileCache(dir), dir
+}
+
+func TestCacheRoundTrip(t *testing.T) {
+	c, dir := tempCache(t)
+	defer os.RemoveAll(dir)
+
+	instances := map[string]service.Instance{
+		testPrefix + "node-1": testInstance("a"),
+		testPrefix + "node-2": testInstance("b"),
+	}
+
+	err := c.save(testPrefix, instances, 7)
+	if err != nil {
+		t.Fatalf("save error = %s", err)
+	}
+
+	loaded, revision, err := c.load(testPrefix)
+	if err != nil {
+		t.Fatalf("load error = %s", err)
+	}
+
+	if revision != 7 || len(loaded) != len(instances) {
+		t.Fatalf("loaded %d instances at revision %d, want %d at revision 7", len(loaded), revision, len(instances))
+	}
+
+	for key, want := range instances {
+		got, ok := loaded[key]
+		if !ok || got.ID != want.ID || got.Address != want.Address || got.Version != want.Version || got.Weight != want.Weight {
+			t.Fatalf("loaded[%s] = %+v, want %+v", key, got, want)
+		}
+	}
+
+	// 没有保存过的目录
+	if _, _, err = c.load("/services/push/other/"); err == nil {
+		t.Fatalf("load of unsaved prefix succeeded")
+	}
+}
+
+func TestCacheRejectsMismatch(t *testing.T) {
+	c, dir := tempCache(t)
+	defer os.RemoveAll(dir)
+
+	write := func(content string) {
+		err := ioutil.WriteFile(c.path(testPrefix), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("write cache error = %s", err)
+		}
+	}
+
+	write(`{"version": 1, "prefix": "` + testPrefix + `", "revision": 3, "instances": {}}`)
+	if _, _, err := c.load(testPrefix); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Fatalf("load error = %v, want version mismatch", err)
+	}
+
+	// 不同目录的文件名可能相同，如/a_b/和/a/b/
+	write(`{"version": 2, "prefix": "/services/push/other/", "revision": 3, "instances": {}}`)
+	if _, _, err := c.load(testPrefix); err == nil || !strings.Contains(err.Error(), "prefix") {
+		t.Fatalf("load error = %v, want prefix mismatch", err)
+	}
+}
+
+func TestWatcherBootstrapsFromCache(t *testing.T) {
+	c, dir := tempCache(t)
+	defer os.RemoveAll(dir)
+
+	err := c.save(testPrefix, map[string]service.Instance{testPrefix + "a": testInstance("a")}, 3)
+	if err != nil {
+		t.Fatalf("save error = %s", err)
+	}
+
+	f := newFakeEtcd()
+	f.put(testPrefix+"b", testInstance("b"))
+	f.setGetErr(errors.New("etcd unavailable"))
+
+	w := newWatcher(f, nil, testPrefix)
+	w.SetDebounce(0)
+	w.SetCacheDir(dir)
+	w.Run()
+	defer w.Close()
+	sub := w.Subscribe(context.Background())
+
+	// etcd不可用时使用缓存中的实例
+	u := waitFor(t, sub, "a")
+	if !u.Stale || u.Revision != 3 {
+		t.Fatalf("update stale = %t, revision = %d, want stale cache at revision 3", u.Stale, u.Revision)
+	}
+
+	// etcd恢复后替换为最新实例，并更新缓存
+	f.setGetErr(nil)
+	u = waitFor(t, sub, "b")
+	if u.Stale {
+		t.Fatalf("update still stale after relist")
+	}
+
+	// 缓存在通知订阅者之后保存
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		loaded, _, err := c.load(testPrefix)
+		if _, ok := loaded[testPrefix+"b"]; ok && len(loaded) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cache = %v, error = %v, want %s", loaded, err, testPrefix+"b")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
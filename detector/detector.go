@@ -0,0 +1,157 @@
+package detector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zjmnssy/serviceRD/service"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// Option 服务发现器配置项
+type Option func(o *options)
+
+type options struct {
+	layout   service.KeyLayout
+	decode   Decoder
+	debounce time.Duration
+	resync   time.Duration
+	cacheDir string
+}
+
+func defaultOptions() options {
+	return options{
+		layout:   service.DefaultLayout,
+		decode:   DefaultDecode,
+		debounce: time.Duration(defaultDebounce) * time.Millisecond,
+		resync:   time.Duration(defaultResync) * time.Millisecond,
+	}
+}
+
+// WithLayout 设置etcd中服务信息的目录布局
+func WithLayout(layout service.KeyLayout) Option {
+	return func(o *options) {
+		o.layout = layout
+	}
+}
+
+// WithDecoder 设置注册记录的解析函数
+func WithDecoder(decode Decoder) Option {
+	return func(o *options) {
+		if decode != nil {
+			o.decode = decode
+		}
+	}
+}
+
+// WithDebounce 设置合并发布的时间窗口
+func WithDebounce(d time.Duration) Option {
+	return func(o *options) {
+		o.debounce = d
+	}
+}
+
+// WithResyncInterval 设置两次全量加载的最小间隔，间隔内的Resync和ResolveNow被忽略
+func WithResyncInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.resync = d
+	}
+}
+
+// WithCacheDir 设置本地缓存目录，etcd不可用时从缓存加载实例，为空时不使用缓存
+func WithCacheDir(dir string) Option {
+	return func(o *options) {
+		o.cacheDir = dir
+	}
+}
+
+// Detector 服务发现器，同一目录的多个订阅共用一个监控器，不依赖grpc
+type Detector struct {
+	client etcdClient
+	opts   options
+
+	lock     sync.Mutex
+	watchers map[string]*sharedWatcher // key为监控目录
+}
+
+type sharedWatcher struct {
+	watcher *Watcher
+	refs    int
+}
+
+// NewDetector 创建服务发现器实例，发现器不负责关闭client
+func NewDetector(client *clientv3.Client, opts ...Option) *Detector {
+	return newDetector(client, opts...)
+}
+
+func newDetector(client etcdClient, opts ...Option) *Detector {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &Detector{
+		client:   client,
+		opts:     o,
+		watchers: make(map[string]*sharedWatcher),
+	}
+}
+
+// Subscribe 订阅某类服务的实例变化，ctx结束或调用Subscription.Close时取消订阅
+func (d *Detector) Subscribe(ctx context.Context, serviceType string) (*Subscription, error) {
+	if serviceType == "" {
+		return nil, fmt.Errorf("empty service type")
+	}
+
+	return d.subscribePrefix(ctx, d.opts.layout.PushPrefix(serviceType)), nil
+}
+
+// Resync 通知某类服务的监控器重新全量加载
+func (d *Detector) Resync(serviceType string) {
+	d.resyncPrefix(d.opts.layout.PushPrefix(serviceType))
+}
+
+func (d *Detector) subscribePrefix(ctx context.Context, prefix string) *Subscription {
+	d.lock.Lock()
+	shared, ok := d.watchers[prefix]
+	if !ok {
+		w := newWatcher(d.client, d.opts.decode, prefix)
+		w.SetDebounce(d.opts.debounce)
+		w.SetResyncInterval(d.opts.resync)
+		w.SetCacheDir(d.opts.cacheDir)
+		w.Run()
+
+		shared = &sharedWatcher{watcher: w}
+		d.watchers[prefix] = shared
+	}
+	shared.refs++
+
+	sub := shared.watcher.Subscribe(ctx)
+	d.lock.Unlock()
+
+	// 订阅关闭后释放引用，没有订阅时关闭监控器
+	sub.onClosed(func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+
+		shared.refs--
+		if shared.refs == 0 && d.watchers[prefix] == shared {
+			delete(d.watchers, prefix)
+			shared.watcher.Close()
+		}
+	})
+
+	return sub
+}
+
+func (d *Detector) resyncPrefix(prefix string) {
+	d.lock.Lock()
+	shared, ok := d.watchers[prefix]
+	d.lock.Unlock()
+
+	if ok {
+		shared.watcher.Resync()
+	}
+}
@@ -0,0 +1,252 @@
+package detector
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zjmnssy/serviceRD/service"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+)
+
+// resolver.Address.Metadata中的字段名
+const (
+	metaVersion    = "version"
+	metaWeight     = "weight"
+	metaServerID   = "serverID"
+	metaServerType = "serverType"
+	metaStatus     = "status"
+	metaRegion     = "region"
+	metaZone       = "zone"
+)
+
+// ExtractAddr 从注册信息中解析出地址和服务ID，删除事件的value为空
+type ExtractAddr func(key string, value string) (resolver.Address, string, error)
+
+// FieldNames 注册记录中各信息对应的JSON字段名
+type FieldNames struct {
+	Address    string
+	ServerID   string
+	ServerType string
+	Version    string
+	Weight     string
+	Status     string
+	Region     string
+	Zone       string
+}
+
+// DefaultFieldNames service.Instance使用的字段名
+var DefaultFieldNames = FieldNames{
+	Address:    "address",
+	ServerID:   "serverID",
+	ServerType: "serverType",
+	Version:    "version",
+	Weight:     "weight",
+	Status:     "status",
+	Region:     "region",
+	Zone:       "zone",
+}
+
+// Decoder 将注册信息解析为服务实例，删除事件的value为空，只需解析出ID
+type Decoder func(key string, value string) (service.Instance, error)
+
+// DefaultDecode 解析service.Instance格式的注册记录，记录中没有ID或删除事件时从注册路径中解析ID
+func DefaultDecode(key string, value string) (service.Instance, error) {
+	if value == "" {
+		_, serverID, err := idFromKey(key)
+		return service.Instance{ID: serverID}, err
+	}
+
+	instance, err := service.DecodeInstance(value)
+	if err != nil {
+		return instance, err
+	}
+
+	if instance.ID == "" {
+		instance.ID = lastSegment(key)
+	}
+
+	return instance, nil
+}
+
+// DefaultExtract 解析service.Instance格式的注册记录，删除事件从注册路径中解析服务ID
+func DefaultExtract(key string, value string) (resolver.Address, string, error) {
+	instance, err := DefaultDecode(key, value)
+	if err != nil {
+		return resolver.Address{}, "", err
+	}
+
+	if value == "" {
+		return resolver.Address{}, instance.ID, nil
+	}
+
+	return toAddress(instance), instance.ID, nil
+}
+
+// DecoderFromExtract 将地址解析函数转换为实例解析函数，地址的Metadata保存在实例的Metadata中
+func DecoderFromExtract(extract ExtractAddr) Decoder {
+	return func(key string, value string) (service.Instance, error) {
+		addr, serverID, err := extract(key, value)
+		if err != nil {
+			return service.Instance{}, err
+		}
+
+		instance := service.Instance{ID: serverID, Address: addr.Addr}
+
+		if m, ok := addr.Metadata.(*map[string]string); ok && m != nil {
+			instance.Metadata = make(map[string]string, len(*m))
+			for k, v := range *m {
+				instance.Metadata[k] = v
+			}
+
+			instance.Type = (*m)[metaServerType]
+			instance.Version = (*m)[metaVersion]
+			instance.Status = (*m)[metaStatus]
+			instance.Weight = service.DefaultWeight
+			if n, err := strconv.Atoi((*m)[metaWeight]); err == nil && n >= 0 {
+				instance.Weight = n
+			}
+			instance.Region = (*m)[metaRegion]
+			instance.Zone = (*m)[metaZone]
+		}
+
+		if instance.ID == "" {
+			instance.ID = lastSegment(key)
+		}
+
+		return instance, nil
+	}
+}
+
+// toAddress 将服务实例转换为grpc地址，实例信息保存在Metadata中供负载均衡使用，
+// 地域和可用区同时保存在Attributes中
+func toAddress(instance service.Instance) resolver.Address {
+	metaData := make(map[string]string, len(instance.Metadata)+7)
+	for k, v := range instance.Metadata {
+		metaData[k] = v
+	}
+
+	metaData[metaVersion] = instance.Version
+	metaData[metaWeight] = strconv.Itoa(instance.Weight)
+	metaData[metaServerID] = instance.ID
+	metaData[metaServerType] = instance.Type
+	metaData[metaStatus] = instance.Status
+	metaData[metaRegion] = instance.Region
+	metaData[metaZone] = instance.Zone
+
+	return resolver.Address{
+		Addr:       instance.Address,
+		Metadata:   &metaData,
+		Attributes: attributes.New(service.AttrRegion, instance.Region, service.AttrZone, instance.Zone),
+	}
+}
+
+// toAddresses 将服务实例列表转换为grpc地址列表
+func toAddresses(instances []service.Instance) []resolver.Address {
+	addrs := make([]resolver.Address, 0, len(instances))
+	for _, instance := range instances {
+		addrs = append(addrs, toAddress(instance))
+	}
+
+	return addrs
+}
+
+// NewExtractor 创建按指定JSON字段名解析注册记录的解析函数，未指定的字段名使用DefaultFieldNames
+func NewExtractor(fields FieldNames) ExtractAddr {
+	fields = fields.withDefault()
+
+	return func(key string, value string) (resolver.Address, string, error) {
+		if value == "" {
+			return idFromKey(key)
+		}
+
+		record := make(map[string]interface{})
+		err := json.Unmarshal([]byte(value), &record)
+		if err != nil {
+			return resolver.Address{}, "", err
+		}
+
+		addr := jsonField(record, fields.Address)
+		if addr == "" {
+			return resolver.Address{}, "", fmt.Errorf("key = %s has no field %s", key, fields.Address)
+		}
+
+		serverID := jsonField(record, fields.ServerID)
+		if serverID == "" {
+			serverID = lastSegment(key)
+		}
+
+		metaData := map[string]string{
+			metaVersion:    jsonField(record, fields.Version),
+			metaWeight:     jsonField(record, fields.Weight),
+			metaServerID:   serverID,
+			metaServerType: jsonField(record, fields.ServerType),
+			metaStatus:     jsonField(record, fields.Status),
+			metaRegion:     jsonField(record, fields.Region),
+			metaZone:       jsonField(record, fields.Zone),
+		}
+
+		return resolver.Address{Addr: addr, Metadata: &metaData}, serverID, nil
+	}
+}
+
+func (f FieldNames) withDefault() FieldNames {
+	if f.Address == "" {
+		f.Address = DefaultFieldNames.Address
+	}
+	if f.ServerID == "" {
+		f.ServerID = DefaultFieldNames.ServerID
+	}
+	if f.ServerType == "" {
+		f.ServerType = DefaultFieldNames.ServerType
+	}
+	if f.Version == "" {
+		f.Version = DefaultFieldNames.Version
+	}
+	if f.Weight == "" {
+		f.Weight = DefaultFieldNames.Weight
+	}
+	if f.Status == "" {
+		f.Status = DefaultFieldNames.Status
+	}
+	if f.Region == "" {
+		f.Region = DefaultFieldNames.Region
+	}
+	if f.Zone == "" {
+		f.Zone = DefaultFieldNames.Zone
+	}
+
+	return f
+}
+
+// jsonField 获取字段的字符串形式，数字字段按整数格式化
+func jsonField(record map[string]interface{}, name string) string {
+	switch v := record[name].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return ""
+	}
+}
+
+// idFromKey 删除事件没有注册记录，服务ID取注册路径的最后一级
+func idFromKey(key string) (resolver.Address, string, error) {
+	serverID := lastSegment(key)
+	if serverID == "" {
+		return resolver.Address{}, "", fmt.Errorf("key = %s error", key)
+	}
+
+	return resolver.Address{}, serverID, nil
+}
+
+func lastSegment(key string) string {
+	key = strings.TrimRight(key, "/")
+
+	return key[strings.LastIndex(key, "/")+1:]
+}
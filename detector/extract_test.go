@@ -0,0 +1,88 @@
+package detector
+
+import (
+	"testing"
+)
+
+func metadataOf(t *testing.T, value interface{}) map[string]string {
+	t.Helper()
+
+	m, ok := value.(*map[string]string)
+	if !ok || m == nil {
+		t.Fatalf("metadata = %v, want *map[string]string", value)
+	}
+
+	return *m
+}
+
+func TestDefaultExtractDelete(t *testing.T) {
+	// 删除事件没有注册记录，服务ID取注册路径的最后一级
+	addr, serverID, err := DefaultExtract(testPrefix+"node-1", "")
+	if err != nil || serverID != "node-1" || addr.Addr != "" {
+		t.Fatalf("extract = %+v, %s, %v, want id node-1 from key", addr, serverID, err)
+	}
+
+	instance, err := DefaultDecode(testPrefix+"node-1", "")
+	if err != nil || instance.ID != "node-1" {
+		t.Fatalf("decode = %+v, %v, want id node-1 from key", instance, err)
+	}
+
+	if _, _, err = DefaultExtract("", ""); err == nil {
+		t.Fatalf("extract of empty key succeeded")
+	}
+}
+
+func TestDefaultExtractWithoutServerID(t *testing.T) {
+	value := `{"serverType": "test", "address": "127.0.0.1:8080", "version": "20190828001", "weight": "2"}`
+
+	addr, serverID, err := DefaultExtract(testPrefix+"node-1", value)
+	if err != nil {
+		t.Fatalf("extract error = %s", err)
+	}
+
+	if serverID != "node-1" || addr.Addr != "127.0.0.1:8080" {
+		t.Fatalf("extract = %s, %s, want node-1 at 127.0.0.1:8080", addr.Addr, serverID)
+	}
+
+	m := metadataOf(t, addr.Metadata)
+	if m[metaServerID] != "node-1" || m[metaWeight] != "2" || m[metaVersion] != "20190828001" {
+		t.Fatalf("metadata = %v", m)
+	}
+}
+
+func TestNewExtractorFieldNames(t *testing.T) {
+	extract := NewExtractor(FieldNames{Address: "endpoint", ServerID: "name", Weight: "w"})
+
+	// 未指定的字段名使用默认值，数字字段按整数格式化
+	value := `{"endpoint": "10.0.0.1:9000", "name": "n1", "w": 3, "version": "20190828002"}`
+	addr, serverID, err := extract(testPrefix+"node-1", value)
+	if err != nil {
+		t.Fatalf("extract error = %s", err)
+	}
+
+	if serverID != "n1" || addr.Addr != "10.0.0.1:9000" {
+		t.Fatalf("extract = %s, %s, want n1 at 10.0.0.1:9000", addr.Addr, serverID)
+	}
+
+	m := metadataOf(t, addr.Metadata)
+	if m[metaServerID] != "n1" || m[metaWeight] != "3" || m[metaVersion] != "20190828002" {
+		t.Fatalf("metadata = %v", m)
+	}
+
+	// 没有服务ID时取注册路径的最后一级
+	_, serverID, err = extract(testPrefix+"node-2", `{"endpoint": "10.0.0.2:9000"}`)
+	if err != nil || serverID != "node-2" {
+		t.Fatalf("extract = %s, %v, want id node-2 from key", serverID, err)
+	}
+
+	// 删除事件
+	_, serverID, err = extract(testPrefix+"node-3", "")
+	if err != nil || serverID != "node-3" {
+		t.Fatalf("extract = %s, %v, want id node-3 from key", serverID, err)
+	}
+
+	// 默认字段名的地址不再识别
+	if _, _, err = extract(testPrefix+"node-4", `{"address": "10.0.0.4:9000"}`); err == nil {
+		t.Fatalf("extract of record without endpoint succeeded")
+	}
+}
@@ -5,14 +5,39 @@ import (
 	"google.golang.org/grpc/resolver"
 )
 
-// RegisterResolver 注册解析器
-func RegisterResolver(scheme string, conf etcd.Config, watchPath string, extract extractAddr) {
-	resolver.Register(&etcdResolver{
+// Scheme 按服务类型解析的默认scheme，目标地址为 etcd:///serviceType
+const Scheme = "etcd"
+
+// RegisterBuilder 注册scheme为Scheme的解析器，服务类型取自目标地址，一个解析器可用于所有服务，
+// extract为nil时直接解析service.Instance
+func RegisterBuilder(conf etcd.Config, extract ExtractAddr) {
+	RegisterBuilderWithOptions(conf, WithDecoder(decoderOf(extract)))
+}
+
+// RegisterBuilderWithOptions 注册scheme为Scheme的解析器，可设置解析函数、本地缓存目录等
+func RegisterBuilderWithOptions(conf etcd.Config, opts ...Option) {
+	resolver.Register(&etcdBuilder{
+		scheme: Scheme,
+		conf:   conf,
+		opts:   opts,
+	})
+}
+
+// RegisterResolver 注册监控固定路径的解析器，extract为nil时直接解析service.Instance
+func RegisterResolver(scheme string, conf etcd.Config, watchPath string, extract ExtractAddr) {
+	resolver.Register(&etcdBuilder{
 		scheme:    scheme,
 		conf:      conf,
 		watchPath: watchPath,
-		extract:   extract,
-		updateCh:  make(chan []resolver.Address, 1000),
-		stopCh:    make(chan struct{}),
+		opts:      []Option{WithDecoder(decoderOf(extract))},
 	})
 }
+
+// decoderOf 未指定地址解析函数时直接解析service.Instance，保留实例的全部信息
+func decoderOf(extract ExtractAddr) Decoder {
+	if extract == nil {
+		return DefaultDecode
+	}
+
+	return DecoderFromExtract(extract)
+}
@@ -0,0 +1,134 @@
+package detector
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/zjmnssy/serviceRD/service"
+	"github.com/zjmnssy/zlog"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// Filter 实例过滤条件，返回false的实例不会出现在查询结果中
+type Filter func(instance service.Instance) bool
+
+// VersionFilter 只保留指定版本的实例
+func VersionFilter(version string) Filter {
+	return func(instance service.Instance) bool {
+		return instance.Version == version
+	}
+}
+
+// ZoneFilter 只保留指定可用区的实例
+func ZoneFilter(zone string) Filter {
+	return func(instance service.Instance) bool {
+		return instance.Zone == zone
+	}
+}
+
+// TagFilter 只保留带有指定标签的实例
+func TagFilter(tag string) Filter {
+	return func(instance service.Instance) bool {
+		for _, t := range instance.Tags {
+			if t == tag {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// List 查询某类服务当前可用的实例，使用默认目录布局和DefaultDecode，与解析器发现的实例一致，
+// 返回按ID排序的实例列表和查询时的etcd revision
+func List(ctx context.Context, client *clientv3.Client, serviceType string, filters ...Filter) ([]service.Instance, int64, error) {
+	return list(ctx, client, service.DefaultLayout, DefaultDecode, serviceType, filters)
+}
+
+// List 使用服务发现器的目录布局和解析函数查询某类服务当前可用的实例
+func (d *Detector) List(ctx context.Context, serviceType string, filters ...Filter) ([]service.Instance, int64, error) {
+	return list(ctx, d.client, d.opts.layout, d.opts.decode, serviceType, filters)
+}
+
+func list(ctx context.Context, client etcdClient, layout service.KeyLayout, decode Decoder, serviceType string, filters []Filter) ([]service.Instance, int64, error) {
+	if serviceType == "" {
+		return nil, 0, fmt.Errorf("empty service type")
+	}
+
+	instances, revision, err := load(ctx, client, layout.PushPrefix(serviceType), decode)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result := make([]service.Instance, 0, len(instances))
+	for _, instance := range sortInstances(instances) {
+		if match(instance, filters) {
+			result = append(result, instance)
+		}
+	}
+
+	return result, revision, nil
+}
+
+func match(instance service.Instance, filters []Filter) bool {
+	for _, filter := range filters {
+		if !filter(instance) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// load 在同一revision上加载目录下所有可用实例，key为注册路径，解析失败和处于下线过程中的实例被忽略
+func load(ctx context.Context, client etcdClient, prefix string, decode Decoder) (map[string]service.Instance, int64, error) {
+	resp, err := client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	instances := make(map[string]service.Instance)
+
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+
+		instance, err := decode(key, string(kv.Value))
+		if err != nil {
+			zlog.Prints(zlog.Warn, "detector", "decode key = %s, error = %s", key, err)
+			continue
+		}
+
+		if instance.IsDraining() {
+			continue
+		}
+
+		instances[key] = instance
+	}
+
+	return instances, resp.Header.Revision, nil
+}
+
+// sortInstances 按ID排序生成实例列表，ID相同时按注册路径排序
+func sortInstances(instances map[string]service.Instance) []service.Instance {
+	keys := make([]string, 0, len(instances))
+	for key := range instances {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := instances[keys[i]].ID, instances[keys[j]].ID
+		if a != b {
+			return a < b
+		}
+
+		return keys[i] < keys[j]
+	})
+
+	list := make([]service.Instance, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, instances[key])
+	}
+
+	return list
+}
@@ -1,61 +1,171 @@
 package detector
 
 import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
 	"github.com/zjmnssy/etcd"
+	"github.com/zjmnssy/serviceRD/service"
+	"go.etcd.io/etcd/clientv3"
 	"google.golang.org/grpc/resolver"
 )
 
-type etcdResolver struct {
+// etcdBuilder 解析器构建器，每个grpc.ClientConn构建一个独立的解析器，同一服务的解析器共用一个监控器
+type etcdBuilder struct {
 	scheme    string
 	conf      etcd.Config
-	watchPath string
-	extract   extractAddr
+	watchPath string // 为空时按目标地址中的服务类型监控
+	opts      []Option
+
+	once     sync.Once
+	detector *Detector
+}
+
+// getDetector 首次构建解析器时创建服务发现器，etcd连接在首次加载时创建，
+// 创建失败由监控器按加载失败处理：通知解析器、使用本地缓存并退避重试
+func (b *etcdBuilder) getDetector() *Detector {
+	b.once.Do(func() {
+		b.detector = newDetector(&lazyClient{conf: b.conf}, b.opts...)
+	})
+
+	return b.detector
+}
+
+// lazyClient 使用时才创建etcd连接，创建失败时返回错误，下次使用时重新创建
+type lazyClient struct {
+	conf etcd.Config
+
+	lock   sync.Mutex
+	client *clientv3.Client
+}
+
+func (c *lazyClient) get() (*clientv3.Client, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	watcher  *Watcher
-	updateCh chan []resolver.Address
-	stopCh   chan struct{}
-	cc       resolver.ClientConn
+	if c.client != nil {
+		return c.client, nil
+	}
+
+	client, err := etcd.Client(c.conf)
+	if err != nil {
+		return nil, err
+	}
+
+	c.client = client
+
+	return client, nil
 }
 
-func (r *etcdResolver) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
-	client, err := etcd.Client(r.conf)
+func (c *lazyClient) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	client, err := c.get()
 	if err != nil {
 		return nil, err
 	}
 
-	r.cc = cc
-	r.watcher = NewWatcher(client, r.updateCh, r.extract, r.watchPath)
-	r.start()
+	return client.Get(ctx, key, opts...)
+}
+
+// Watch 连接创建失败时返回已关闭的通道，监控器随后重试
+func (c *lazyClient) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	client, err := c.get()
+	if err != nil {
+		ch := make(chan clientv3.WatchResponse)
+		close(ch)
+		return ch
+	}
+
+	return client.Watch(ctx, key, opts...)
+}
+
+func (b *etcdBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	watchPath := b.watchPath
+	serviceType := strings.Trim(target.Endpoint, "/")
+	if watchPath == "" && serviceType == "" {
+		return nil, fmt.Errorf("no service type in target, want %s:///serviceType", b.scheme)
+	}
+
+	d := b.getDetector()
+
+	if watchPath == "" {
+		watchPath = d.opts.layout.PushPrefix(serviceType)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r := &etcdResolver{
+		cc:        cc,
+		detector:  d,
+		watchPath: watchPath,
+		cancel:    cancel,
+		addrs:     make(map[string]cachedAddr),
+	}
+	r.start(d.subscribePrefix(ctx, watchPath))
 
 	return r, nil
 }
 
-func (r *etcdResolver) Scheme() string {
-	return r.scheme
+func (b *etcdBuilder) Scheme() string {
+	return b.scheme
 }
 
-func (r *etcdResolver) start() {
-	r.watcher.Run()
+// cachedAddr 实例对应的地址，实例不变时复用同一地址，避免balancer重建连接
+type cachedAddr struct {
+	instance service.Instance
+	addr     resolver.Address
+}
 
+// etcdResolver 单个grpc.ClientConn的解析器
+type etcdResolver struct {
+	cc        resolver.ClientConn
+	detector  *Detector
+	watchPath string
+	cancel    context.CancelFunc
+	addrs     map[string]cachedAddr // key为实例ID，只在通知协程中访问
+}
+
+func (r *etcdResolver) start(sub *Subscription) {
 	go func() {
-		for {
-			select {
-			case <-r.stopCh:
-				{
-					r.Close()
-				}
-			case addrs := <-r.updateCh:
-				{
-					r.cc.UpdateState(resolver.State{Addresses: addrs})
-				}
+		for u := range sub.Updates() {
+			// etcd不可用时仍使用本地缓存的实例
+			if u.Err != nil && !u.Stale {
+				r.cc.ReportError(u.Err)
+				continue
 			}
+
+			r.cc.UpdateState(resolver.State{Addresses: r.toAddresses(u.Instances)})
 		}
 	}()
 }
 
+// toAddresses 将实例列表转换为地址列表，复用未变化实例的地址
+func (r *etcdResolver) toAddresses(instances []service.Instance) []resolver.Address {
+	addrs := make([]resolver.Address, 0, len(instances))
+	cache := make(map[string]cachedAddr, len(instances))
+
+	for _, instance := range instances {
+		c, ok := r.addrs[instance.ID]
+		if !ok || !reflect.DeepEqual(c.instance, instance) {
+			c = cachedAddr{instance: instance, addr: toAddress(instance)}
+		}
+
+		cache[instance.ID] = c
+		addrs = append(addrs, c.addr)
+	}
+
+	r.addrs = cache
+
+	return addrs
+}
+
+// ResolveNow 重新全量加载，距上次全量加载不足最小间隔时忽略
 func (r *etcdResolver) ResolveNow(o resolver.ResolveNowOptions) {
+	r.detector.resyncPrefix(r.watchPath)
 }
 
 func (r *etcdResolver) Close() {
-	r.watcher.Close()
+	r.cancel()
 }
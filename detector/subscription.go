@@ -0,0 +1,126 @@
+package detector
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/zjmnssy/serviceRD/service"
+)
+
+// Update 服务实例变化通知，Instances及各差异列表发布后不再修改，调用方不要修改
+type Update struct {
+	Instances []service.Instance // 当前全部可用实例，按ID排序
+	Added     []service.Instance // 相对上一次收到的通知新增的实例
+	Removed   []service.Instance // 相对上一次收到的通知移除的实例
+	Updated   []service.Instance // 相对上一次收到的通知信息有变化的实例
+	Revision  int64              // 对应的etcd revision
+	Stale     bool               // 实例来自本地缓存，etcd恢复后会被替换
+	Err       error              // 加载失败的原因，不为nil时Instances为上一次的实例
+}
+
+// Subscription 服务实例订阅，消费不及时时未读取的通知会与新通知合并，差异始终相对上一次读取的通知
+type Subscription struct {
+	ch        chan Update
+	lock      sync.Mutex
+	delivered []service.Instance // 订阅方已读取的最新实例列表
+	pending   []service.Instance // 通道中尚未读取的实例列表
+	closed    bool
+	closeOnce sync.Once
+	doneCh    chan struct{} // 订阅关闭时关闭
+	hooks     []func()
+}
+
+func newSubscription(onClose func()) *Subscription {
+	return &Subscription{
+		ch:     make(chan Update, 1),
+		doneCh: make(chan struct{}),
+		hooks:  []func(){onClose},
+	}
+}
+
+// Updates 获取通知通道，订阅关闭后通道关闭
+func (s *Subscription) Updates() <-chan Update {
+	return s.ch
+}
+
+// Close 取消订阅
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		s.lock.Lock()
+		s.closed = true
+		close(s.ch)
+		close(s.doneCh)
+		hooks := s.hooks
+		s.hooks = nil
+		s.lock.Unlock()
+
+		for _, h := range hooks {
+			h()
+		}
+	})
+}
+
+// onClosed 增加订阅关闭后的回调，已关闭时立即调用
+func (s *Subscription) onClosed(h func()) {
+	s.lock.Lock()
+	if !s.closed {
+		s.hooks = append(s.hooks, h)
+		s.lock.Unlock()
+		return
+	}
+	s.lock.Unlock()
+
+	h()
+}
+
+// publish 发布新的实例列表，通道中有未读取的通知时替换它
+func (s *Subscription) publish(u Update) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	select {
+	case <-s.ch:
+		// 未读取的通知被替换，差异相对于订阅方实际读取过的列表
+	default:
+		if s.pending != nil {
+			s.delivered = s.pending
+		}
+	}
+
+	u.Added, u.Removed, u.Updated = diff(s.delivered, u.Instances)
+
+	s.pending = u.Instances
+	s.ch <- u
+}
+
+// diff 比较两个按ID排序的实例列表
+func diff(old []service.Instance, new []service.Instance) (added []service.Instance, removed []service.Instance, updated []service.Instance) {
+	oldMap := make(map[string]service.Instance, len(old))
+	for _, instance := range old {
+		oldMap[instance.ID] = instance
+	}
+
+	newMap := make(map[string]service.Instance, len(new))
+	for _, instance := range new {
+		newMap[instance.ID] = instance
+
+		prev, ok := oldMap[instance.ID]
+		if !ok {
+			added = append(added, instance)
+		} else if !reflect.DeepEqual(prev, instance) {
+			updated = append(updated, instance)
+		}
+	}
+
+	for _, instance := range old {
+		if _, ok := newMap[instance.ID]; !ok {
+			removed = append(removed, instance)
+		}
+	}
+
+	return added, removed, updated
+}
@@ -1,23 +1,19 @@
 package detector
 
-import "google.golang.org/grpc/resolver"
+import (
+	"time"
 
-func getDataFromMeta(addr resolver.Address, key string) (string, bool) {
-	var ok bool
-	var metadata *map[string]string
-	var data string
+	"github.com/zjmnssy/serviceRD/internal/backoff"
+)
 
-	if addr.Metadata != nil {
-		metadata, ok = addr.Metadata.(*map[string]string)
-		if ok {
-			data, ok = (*metadata)[key]
-			if !ok {
-				return data, false
-			}
-		} else {
-			return data, false
-		}
-	}
+const (
+	defaultBackoffBase = 500   // per - Millisecond
+	defaultBackoffMax  = 10000 // per - Millisecond
+	defaultDebounce    = 100   // per - Millisecond
+	defaultResync      = 1000  // 两次全量加载的最小间隔，per - Millisecond
+)
 
-	return data, true
+// retryDelay 第retries次重试前的等待时间
+func retryDelay(retries int) time.Duration {
+	return backoff.Duration(time.Duration(defaultBackoffBase)*time.Millisecond, time.Duration(defaultBackoffMax)*time.Millisecond, retries)
 }
@@ -4,224 +4,458 @@ import (
 	"sync"
 	"time"
 
-	"github.com/zjmnssy/etcd"
+	"github.com/zjmnssy/serviceRD/service"
 	"github.com/zjmnssy/zlog"
 	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
 	"golang.org/x/net/context"
-	"google.golang.org/grpc/resolver"
 )
 
-type extractAddr func(key string, value string) (resolver.Address, string, error)
+// etcdClient 监控器使用的etcd接口，由*clientv3.Client实现
+type etcdClient interface {
+	Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error)
+	Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan
+}
 
-// Watcher 服务监控器
+// Watcher 服务监控器，监控某一目录下的服务实例并通知所有订阅者
 type Watcher struct {
-	client      *clientv3.Client
-	updateCh    chan []resolver.Address
-	extract     extractAddr
+	client      etcdClient
+	decode      Decoder
 	watchPrefix string
+	debounce    time.Duration
+	minResync   time.Duration // 两次全量加载的最小间隔，间隔内的Resync被忽略
+	cache       *fileCache
 
 	ctx        context.Context
 	cancel     context.CancelFunc
-	alladdrs   []resolver.Address
-	initFinish chan struct{}
+	instances  map[string]service.Instance // key为注册路径
+	snapshot   []service.Instance          // 最近一次发布的列表，发布后不再修改
+	publishRev int64                       // 最近一次发布的列表对应的revision
+	lastErr    error                       // 最近一次加载失败的原因，加载成功后清空
+	stale      bool                        // 实例来自本地缓存，全量加载成功后清除
+	listedAt   time.Time                   // 最近一次尝试全量加载的时间
+	subs       map[*Subscription]struct{}
+	revision   int64       // 已处理到的revision，只在run协程中访问
+	flushTimer *time.Timer // 等待合并发布的定时器，只在run协程中访问
 	lock       sync.Mutex
+	resyncCh   chan struct{}
 	stopCh     chan struct{}
+	closeOnce  sync.Once
 }
 
-// NewWatcher 创建服务监控器实例
-func NewWatcher(client *clientv3.Client,
-	update chan []resolver.Address,
-	extract extractAddr, prefix string) *Watcher {
+// NewWatcher 创建服务监控器实例，decode为nil时使用DefaultDecode，监控器不负责关闭client
+func NewWatcher(client *clientv3.Client, decode Decoder, prefix string) *Watcher {
+	return newWatcher(client, decode, prefix)
+}
+
+func newWatcher(client etcdClient, decode Decoder, prefix string) *Watcher {
+	if decode == nil {
+		decode = DefaultDecode
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	w := &Watcher{
 		client:      client,
-		updateCh:    update,
-		extract:     extract,
+		decode:      decode,
 		watchPrefix: prefix,
+		debounce:    time.Duration(defaultDebounce) * time.Millisecond,
+		minResync:   time.Duration(defaultResync) * time.Millisecond,
 		ctx:         ctx,
 		cancel:      cancel,
-		alladdrs:    make([]resolver.Address, 0, 0),
-		initFinish:  make(chan struct{}),
+		instances:   make(map[string]service.Instance),
+		subs:        make(map[*Subscription]struct{}),
+		resyncCh:    make(chan struct{}, 1),
 		stopCh:      make(chan struct{}),
 	}
 
 	return w
 }
 
-func (w *Watcher) initialize() []resolver.Address {
-	retAddrs := make([]resolver.Address, 0, 0)
+// SetDebounce 设置合并发布的时间窗口，窗口内的多次变化只发布一次，小于等于0时每次变化立即发布，需在Run之前调用
+func (w *Watcher) SetDebounce(d time.Duration) {
+	w.debounce = d
+}
+
+// SetResyncInterval 设置两次全量加载的最小间隔，距上次全量加载不足此间隔的Resync被忽略，需在Run之前调用
+func (w *Watcher) SetResyncInterval(d time.Duration) {
+	w.minResync = d
+}
+
+// SetCacheDir 设置本地缓存目录，每次发布后保存实例列表，启动时etcd不可用则从缓存加载，需在Run之前调用
+func (w *Watcher) SetCacheDir(dir string) {
+	if dir == "" {
+		w.cache = nil
+		return
+	}
+
+	w.cache = newFileCache(dir)
+}
+
+// Snapshot 获取最近一次发布的实例列表，返回的列表不会再被修改，调用方不要修改
+func (w *Watcher) Snapshot() []service.Instance {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.snapshot
+}
+
+// Subscribe 订阅实例变化，已有发布过的实例列表时立即收到一次通知，ctx结束或调用Close时取消订阅
+func (w *Watcher) Subscribe(ctx context.Context) *Subscription {
+	var sub *Subscription
+	sub = newSubscription(func() {
+		w.lock.Lock()
+		delete(w.subs, sub)
+		w.lock.Unlock()
+	})
+
+	w.lock.Lock()
+	w.subs[sub] = struct{}{}
+	if w.snapshot != nil || w.lastErr != nil {
+		sub.publish(w.current())
+	}
+	w.lock.Unlock()
+
+	// 订阅被直接关闭时协程随之退出
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-w.stopCh:
+		case <-sub.doneCh:
+		}
+		sub.Close()
+	}()
+
+	return sub
+}
+
+// Resync 通知监控器重新全量加载，距上次全量加载不足最小间隔时忽略，避免频繁的ResolveNow反复全量加载
+func (w *Watcher) Resync() {
+	w.lock.Lock()
+	recent := time.Since(w.listedAt) < w.minResync
+	w.lock.Unlock()
+
+	if recent {
+		return
+	}
+
+	select {
+	case w.resyncCh <- struct{}{}:
+	default:
+	}
+}
+
+// initialize 在某一revision上全量加载，之后从revision+1开始监控，保证加载和监控之间的变化不丢失也不重复
+func (w *Watcher) initialize() error {
+	w.lock.Lock()
+	w.listedAt = time.Now()
+	w.lock.Unlock()
 
 	ctxNow, cancel := context.WithTimeout(w.ctx, time.Duration(2)*time.Second)
 	defer cancel()
 
-	_, dataMap, err := etcd.GetPrefix(ctxNow, w.client, w.watchPrefix)
+	instances, revision, err := load(ctxNow, w.client, w.watchPrefix, w.decode)
 	if err != nil {
-		zlog.Prints(zlog.Warn, "watcher", "etcd get error = %s", err)
-		w.reset(retAddrs)
-		w.initFinish <- struct{}{}
-		return retAddrs
+		return err
 	}
 
-	for k, v := range dataMap {
-		addr, _, err := w.extract(k, v)
-		if err != nil {
-			zlog.Prints(zlog.Warn, "watcher", "extract addr error = %s", err)
-			continue
+	w.revision = revision
+	w.reset(instances)
+
+	return nil
+}
+
+// watch的结束原因
+const (
+	watchStopped = iota // 监控器已关闭
+	watchRelist         // 需要重新全量加载
+	watchResume         // 监控中断，从最后的revision继续监控
+)
+
+// run 全量加载后监控增量变化，加载失败时退避重试，监控中断时从最后的revision继续，
+// revision已被压缩或主动要求时重新全量加载
+func (w *Watcher) run() {
+	retries := 0
+	relist := true
+
+	for {
+		if relist {
+			err := w.initialize()
+			if err != nil {
+				zlog.Prints(zlog.Warn, "watcher", "etcd get error = %s", err)
+				w.bootstrap()
+				w.fail(err)
+
+				if _, ok := w.sleep(retryDelay(retries)); !ok {
+					return
+				}
+				retries++
+
+				continue
+			}
+
+			relist = false
 		}
 
-		retAddrs = append(retAddrs, addr)
+		switch w.watch() {
+		case watchStopped:
+			return
+		case watchRelist:
+			retries = 0
+			relist = true
+		case watchResume:
+			resync, ok := w.sleep(retryDelay(retries))
+			if !ok {
+				return
+			}
+			relist = resync
+			retries++
+		}
 	}
+}
 
-	w.reset(retAddrs)
-	w.initFinish <- struct{}{}
-
-	return retAddrs
+// sleep 等待d时间，收到重新加载通知时提前返回resync为true，ok为false表示监控器已关闭
+func (w *Watcher) sleep(d time.Duration) (resync bool, ok bool) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return false, true
+	case <-w.resyncCh:
+		return true, true
+	case <-w.stopCh:
+		return false, false
+	}
 }
 
-func (w *Watcher) watch() {
-	etcdData := make(chan etcd.WatchData, 10000)
+// watch 从revision+1开始监控增量变化
+func (w *Watcher) watch() int {
+	ctx, cancel := context.WithCancel(w.ctx)
+	defer cancel()
 
-	go etcd.WatchPrefix(w.ctx, w.client, w.watchPrefix, etcdData, w.stopCh)
+	// 退出监控时立即发布尚未发布的变化
+	defer func() {
+		if w.flushTimer != nil {
+			w.publish()
+		}
+	}()
 
-	<-w.initFinish
+	wch := w.client.Watch(ctx, w.watchPrefix, clientv3.WithPrefix(), clientv3.WithRev(w.revision+1))
 
 	for {
 		select {
-		case data := <-etcdData:
+		case resp, ok := <-wch:
 			{
-				switch data.Operate {
-				case etcd.MethodCreate:
-					{
-						addr, _, err := w.extract(data.Key, data.Value)
-						if err == nil {
-							w.add(addr)
-						} else {
-							zlog.Prints(zlog.Warn, "watcher", "extract addr error = %s", err)
-						}
-					}
-				case etcd.MethodPut:
-					{
-						addr, _, err := w.extract(data.Key, data.Value)
-						if err == nil {
-							w.add(addr)
-						} else {
-							zlog.Prints(zlog.Warn, "watcher", "extract addr error = %s", err)
-						}
-					}
-				case etcd.MethodDelete:
-					{
-						_, serverID, err := w.extract(data.Key, data.Value)
-						if err == nil {
-							w.delete(serverID)
-						} else {
-							zlog.Prints(zlog.Warn, "watcher", "extract data.Key = %s , data.Value = %s, error = %s", data.Key, data.Value, err)
-						}
-					}
-				case etcd.MethodModify:
-					{
-						addr, serverID, err := w.extract(data.Key, data.Value)
-						if err == nil {
-							w.modify(serverID, addr)
-						} else {
-							zlog.Prints(zlog.Warn, "watcher", "extract addr error = %s", err)
-						}
-					}
-				default:
-					{
-						zlog.Prints(zlog.Warn, "watcher", "not suport method = %s", data.Operate)
-					}
+				if !ok {
+					zlog.Prints(zlog.Warn, "watcher", "watch channel closed, resume from revision %d", w.revision)
+					return watchResume
+				}
+
+				if resp.CompactRevision != 0 || resp.Err() == rpctypes.ErrCompacted {
+					zlog.Prints(zlog.Warn, "watcher", "revision %d compacted to %d, relist", w.revision, resp.CompactRevision)
+					return watchRelist
 				}
+
+				if resp.Canceled || resp.Err() != nil {
+					zlog.Prints(zlog.Warn, "watcher", "watch canceled, error = %v, resume from revision %d", resp.Err(), w.revision)
+					return watchResume
+				}
+
+				// 先更新revision，未合并发布时通知中的revision与事件一致
+				for _, ev := range resp.Events {
+					w.revision = ev.Kv.ModRevision
+					w.handle(ev)
+				}
+
+				if resp.Header.Revision > w.revision {
+					w.revision = resp.Header.Revision
+				}
+			}
+		case <-w.flushC():
+			{
+				w.publish()
+			}
+		case <-w.resyncCh:
+			{
+				return watchRelist
 			}
 		case <-w.stopCh:
 			{
-				return
+				return watchStopped
 			}
 		}
 	}
 }
 
-func (w *Watcher) add(addr resolver.Address) {
-	w.lock.Lock()
-	defer w.lock.Unlock()
+func (w *Watcher) handle(ev *clientv3.Event) {
+	key := string(ev.Kv.Key)
 
-	newServerID, ok := getDataFromMeta(addr, "serverID")
-	if !ok {
+	if ev.Type == clientv3.EventTypeDelete {
+		w.delete(key)
 		return
 	}
 
-	for _, v := range w.alladdrs {
-		oldServerID, ok := getDataFromMeta(v, "serverID")
-		if !ok {
-			return
-		}
+	instance, err := w.decode(key, string(ev.Kv.Value))
+	if err != nil {
+		zlog.Prints(zlog.Warn, "watcher", "decode key = %s, error = %s", key, err)
+		return
+	}
 
-		if newServerID == oldServerID {
-			return
-		}
+	// 实例标记为draining时从列表中移除，恢复后重新加入
+	if instance.IsDraining() {
+		w.delete(key)
+		return
 	}
 
-	w.alladdrs = append(w.alladdrs, addr)
-	zlog.Prints(zlog.Debug, "watcher", "add w.alladdrs : %v", w.alladdrs)
-	w.updateCh <- w.alladdrs
-	zlog.Prints(zlog.Debug, "watcher", "add ok ")
+	w.set(key, instance)
 }
 
-func (w *Watcher) delete(serverID string) {
+func (w *Watcher) set(key string, instance service.Instance) {
 	w.lock.Lock()
-	defer w.lock.Unlock()
+	w.instances[key] = instance
+	w.lock.Unlock()
 
-	for i, v := range w.alladdrs {
-		oldServerID, ok := getDataFromMeta(v, "serverID")
-		if !ok {
-			return
-		}
+	w.changed()
+}
 
-		if serverID == oldServerID {
-			w.alladdrs = append(w.alladdrs[:i], w.alladdrs[i+1:]...)
-			w.updateCh <- w.alladdrs
-			return
-		}
+func (w *Watcher) delete(key string) {
+	w.lock.Lock()
+	_, ok := w.instances[key]
+	delete(w.instances, key)
+	w.lock.Unlock()
+
+	if ok {
+		w.changed()
 	}
 }
 
-func (w *Watcher) modify(serverID string, addr resolver.Address) {
+// reset 全量加载后替换所有实例并立即发布
+func (w *Watcher) reset(instances map[string]service.Instance) {
 	w.lock.Lock()
-	defer w.lock.Unlock()
+	w.instances = instances
+	w.lastErr = nil
+	w.stale = false
+	w.lock.Unlock()
 
-	for i, v := range w.alladdrs {
-		oldServerID, ok := getDataFromMeta(v, "serverID")
-		if !ok {
-			return
-		}
+	w.publish()
+}
 
-		if serverID == oldServerID {
-			w.alladdrs = append(w.alladdrs[:i], w.alladdrs[i+1:]...)
-			w.alladdrs = append(w.alladdrs, addr)
-			w.updateCh <- w.alladdrs
-			return
-		}
+// bootstrap 从未加载成功过时使用本地缓存的实例列表，标记为stale
+func (w *Watcher) bootstrap() {
+	if w.cache == nil {
+		return
+	}
+
+	w.lock.Lock()
+	loaded := w.snapshot != nil
+	w.lock.Unlock()
+
+	if loaded {
+		return
+	}
+
+	instances, revision, err := w.cache.load(w.watchPrefix)
+	if err != nil {
+		zlog.Prints(zlog.Warn, "watcher", "load cache of %s error = %s", w.watchPrefix, err)
+		return
 	}
+
+	zlog.Prints(zlog.Warn, "watcher", "etcd unavailable, use %d cached instances of %s at revision %d", len(instances), w.watchPrefix, revision)
+
+	w.lock.Lock()
+	w.instances = instances
+	w.stale = true
+	w.lock.Unlock()
+
+	w.revision = revision
+	w.publish()
 }
 
-func (w *Watcher) reset(list []resolver.Address) {
+// fail 通知订阅者加载失败，实例列表保持不变
+func (w *Watcher) fail(err error) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	w.alladdrs = list
-	w.updateCh <- w.alladdrs
+	w.lastErr = err
+	u := w.current()
+	for sub := range w.subs {
+		sub.publish(u)
+	}
+}
+
+// current 最近一次发布的状态，需持有锁
+func (w *Watcher) current() Update {
+	return Update{Instances: w.snapshot, Revision: w.publishRev, Stale: w.stale, Err: w.lastErr}
+}
+
+// changed 实例有变化，在合并窗口结束时发布
+func (w *Watcher) changed() {
+	if w.debounce <= 0 {
+		w.publish()
+		return
+	}
+
+	if w.flushTimer == nil {
+		w.flushTimer = time.NewTimer(w.debounce)
+	}
+}
+
+// flushC 合并发布定时器的通道，没有待发布的变化时返回nil
+func (w *Watcher) flushC() <-chan time.Time {
+	if w.flushTimer == nil {
+		return nil
+	}
+
+	return w.flushTimer.C
+}
+
+// publish 生成新的实例列表并通知所有订阅者，设置了缓存目录时保存非缓存来源的列表
+func (w *Watcher) publish() {
+	if w.flushTimer != nil {
+		w.flushTimer.Stop()
+		w.flushTimer = nil
+	}
+
+	w.lock.Lock()
+	snapshot := sortInstances(w.instances)
+	w.snapshot = snapshot
+	w.publishRev = w.revision
+	stale := w.stale
+
+	var saved map[string]service.Instance
+	if w.cache != nil && !stale {
+		saved = make(map[string]service.Instance, len(w.instances))
+		for key, instance := range w.instances {
+			saved[key] = instance
+		}
+	}
+
+	zlog.Prints(zlog.Debug, "watcher", "publish %d instances of %s", len(snapshot), w.watchPrefix)
+
+	u := w.current()
+	for sub := range w.subs {
+		sub.publish(u)
+	}
+	w.lock.Unlock()
+
+	if saved != nil {
+		err := w.cache.save(w.watchPrefix, saved, w.revision)
+		if err != nil {
+			zlog.Prints(zlog.Warn, "watcher", "save cache of %s error = %s", w.watchPrefix, err)
+		}
+	}
 }
 
 // Run 启动监控器
 func (w *Watcher) Run() {
-	go w.watch()
-	w.initialize()
+	go w.run()
 }
 
-// Close 关闭监控器
+// Close 关闭监控器，所有订阅随之关闭
 func (w *Watcher) Close() {
-	w.stopCh <- struct{}{}
-	w.cancel()
-	w.client.Close()
+	w.closeOnce.Do(func() {
+		close(w.stopCh)
+		w.cancel()
+	})
 }
@@ -0,0 +1,368 @@
+package detector
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zjmnssy/serviceRD/service"
+	"go.etcd.io/etcd/clientv3"
+	pb "go.etcd.io/etcd/etcdserver/etcdserverpb"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+const testPrefix = "/services/push/test/"
+
+// fakeEtcd 内存中的etcd，保存全部历史事件，支持按revision监控、断开监控和压缩
+type fakeEtcd struct {
+	lock      sync.Mutex
+	rev       int64
+	compacted int64
+	kvs       map[string]*mvccpb.KeyValue
+	history   []*clientv3.Event
+	watches   map[*fakeWatch]struct{}
+	getRevs   []int64 // 每次Get返回的revision
+	watchRevs []int64 // 每次Watch的起始revision
+	afterGet  func()  // Get返回前调用一次，模拟加载和监控之间的写入
+	getErr    error   // 不为nil时Get返回此错误，模拟etcd不可用
+}
+
+type fakeWatch struct {
+	ch chan clientv3.WatchResponse
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		rev:     1,
+		kvs:     make(map[string]*mvccpb.KeyValue),
+		watches: make(map[*fakeWatch]struct{}),
+	}
+}
+
+func (f *fakeEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	f.lock.Lock()
+	if f.getErr != nil {
+		err := f.getErr
+		f.lock.Unlock()
+		return nil, err
+	}
+
+	resp := &clientv3.GetResponse{Header: &pb.ResponseHeader{Revision: f.rev}}
+	for _, kv := range f.kvs {
+		resp.Kvs = append(resp.Kvs, kv)
+	}
+	f.getRevs = append(f.getRevs, f.rev)
+	afterGet := f.afterGet
+	f.afterGet = nil
+	f.lock.Unlock()
+
+	if afterGet != nil {
+		afterGet()
+	}
+
+	return resp, nil
+}
+
+func (f *fakeEtcd) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	rev := clientv3.OpGet(key, opts...).Rev()
+	f.watchRevs = append(f.watchRevs, rev)
+
+	fw := &fakeWatch{ch: make(chan clientv3.WatchResponse, 100)}
+
+	if rev <= f.compacted {
+		fw.ch <- clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: f.rev}, CompactRevision: f.compacted, Canceled: true}
+		close(fw.ch)
+		return fw.ch
+	}
+
+	events := make([]*clientv3.Event, 0)
+	for _, ev := range f.history {
+		if ev.Kv.ModRevision >= rev {
+			events = append(events, ev)
+		}
+	}
+	if len(events) > 0 {
+		fw.ch <- clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: f.rev}, Events: events}
+	}
+
+	f.watches[fw] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		if _, ok := f.watches[fw]; ok {
+			delete(f.watches, fw)
+			close(fw.ch)
+		}
+	}()
+
+	return fw.ch
+}
+
+func (f *fakeEtcd) put(key string, instance service.Instance) {
+	value, err := instance.Encode()
+	if err != nil {
+		panic(err)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.rev++
+	kv := &mvccpb.KeyValue{Key: []byte(key), Value: []byte(value), ModRevision: f.rev}
+	f.kvs[key] = kv
+	f.notify(&clientv3.Event{Type: clientv3.EventTypePut, Kv: kv})
+}
+
+func (f *fakeEtcd) delete(key string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.rev++
+	delete(f.kvs, key)
+	f.notify(&clientv3.Event{Type: clientv3.EventTypeDelete, Kv: &mvccpb.KeyValue{Key: []byte(key), ModRevision: f.rev}})
+}
+
+// notify 记录事件并发送给所有监控，需持有锁
+func (f *fakeEtcd) notify(ev *clientv3.Event) {
+	f.history = append(f.history, ev)
+
+	for fw := range f.watches {
+		fw.ch <- clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: f.rev}, Events: []*clientv3.Event{ev}}
+	}
+}
+
+// disconnect 关闭所有监控通道，模拟连接中断
+func (f *fakeEtcd) disconnect() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for fw := range f.watches {
+		delete(f.watches, fw)
+		close(fw.ch)
+	}
+}
+
+// compact 压缩当前revision之前的历史
+func (f *fakeEtcd) compact() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.compacted = f.rev
+}
+
+func (f *fakeEtcd) setGetErr(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.getErr = err
+}
+
+func (f *fakeEtcd) revisions() (gets []int64, watches []int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]int64(nil), f.getRevs...), append([]int64(nil), f.watchRevs...)
+}
+
+func testInstance(id string) service.Instance {
+	return service.Instance{Type: "test", ID: id, Address: id + ":8080", Version: "20190828001", Weight: 1}
+}
+
+func startWatcher(f *fakeEtcd) (*Watcher, *Subscription) {
+	w := newWatcher(f, nil, testPrefix)
+	w.SetDebounce(0)
+	w.Run()
+
+	return w, w.Subscribe(context.Background())
+}
+
+// waitFor 等待实例ID列表与want一致
+func waitFor(t *testing.T, sub *Subscription, want ...string) Update {
+	t.Helper()
+
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+
+	var last []string
+	for {
+		select {
+		case u, ok := <-sub.Updates():
+			{
+				if !ok {
+					t.Fatalf("subscription closed, last instances = %v, want %v", last, want)
+				}
+
+				last = ids(u.Instances)
+				if equalIDs(last, want) {
+					return u
+				}
+			}
+		case <-timer.C:
+			{
+				t.Fatalf("timeout, last instances = %v, want %v", last, want)
+			}
+		}
+	}
+}
+
+func ids(instances []service.Instance) []string {
+	list := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		list = append(list, instance.ID)
+	}
+
+	return list
+}
+
+func equalIDs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestWatcherKeepsEventsBetweenListAndWatch(t *testing.T) {
+	f := newFakeEtcd()
+	f.put(testPrefix+"a", testInstance("a"))
+	f.put(testPrefix+"b", testInstance("b"))
+
+	// 加载完成后、监控开始前新增c并删除b
+	f.afterGet = func() {
+		f.put(testPrefix+"c", testInstance("c"))
+		f.delete(testPrefix + "b")
+	}
+
+	w, sub := startWatcher(f)
+	defer w.Close()
+	waitFor(t, sub, "a", "c")
+
+	gets, watches := f.revisions()
+	if len(gets) != 1 || len(watches) != 1 || watches[0] != gets[0]+1 {
+		t.Fatalf("get revisions = %v, watch revisions = %v, want watch from get revision + 1", gets, watches)
+	}
+}
+
+func TestWatcherDeletesByKey(t *testing.T) {
+	f := newFakeEtcd()
+
+	// 注册路径中的ID与记录中的ID不一致时，删除事件仍能匹配到实例
+	f.put(testPrefix+"node-1", testInstance("a"))
+
+	w, sub := startWatcher(f)
+	defer w.Close()
+	waitFor(t, sub, "a")
+
+	f.delete(testPrefix + "node-1")
+	waitFor(t, sub)
+}
+
+func TestWatcherResumesAfterChannelClosed(t *testing.T) {
+	f := newFakeEtcd()
+	f.put(testPrefix+"a", testInstance("a"))
+
+	w, sub := startWatcher(f)
+	defer w.Close()
+	waitFor(t, sub, "a")
+
+	f.put(testPrefix+"b", testInstance("b"))
+	u := waitFor(t, sub, "a", "b")
+
+	// 中断期间的变化在恢复监控后补齐
+	f.disconnect()
+	f.put(testPrefix+"c", testInstance("c"))
+	f.delete(testPrefix + "a")
+	waitFor(t, sub, "b", "c")
+
+	gets, watches := f.revisions()
+	if len(gets) != 1 {
+		t.Fatalf("get revisions = %v, want no relist", gets)
+	}
+	if len(watches) != 2 || watches[1] != u.Revision+1 {
+		t.Fatalf("watch revisions = %v, want resume from %d", watches, u.Revision+1)
+	}
+}
+
+func TestWatcherRelistsAfterCompaction(t *testing.T) {
+	f := newFakeEtcd()
+	f.put(testPrefix+"a", testInstance("a"))
+	f.put(testPrefix+"b", testInstance("b"))
+
+	w, sub := startWatcher(f)
+	defer w.Close()
+	waitFor(t, sub, "a", "b")
+
+	// 中断期间的历史被压缩，只能重新全量加载
+	f.disconnect()
+	f.put(testPrefix+"c", testInstance("c"))
+	f.delete(testPrefix + "a")
+	f.compact()
+	u := waitFor(t, sub, "b", "c")
+
+	// 重新加载后继续监控
+	f.put(testPrefix+"d", testInstance("d"))
+	waitFor(t, sub, "b", "c", "d")
+
+	gets, watches := f.revisions()
+	if len(gets) != 2 {
+		t.Fatalf("get revisions = %v, want relist after compaction", gets)
+	}
+	if u.Revision != gets[1] {
+		t.Fatalf("update revision = %d, want %d", u.Revision, gets[1])
+	}
+	if len(watches) != 3 || watches[2] != gets[1]+1 {
+		t.Fatalf("watch revisions = %v, want watch from %d after relist", watches, gets[1]+1)
+	}
+}
+
+func TestWatcherRateLimitsResync(t *testing.T) {
+	f := newFakeEtcd()
+	f.put(testPrefix+"a", testInstance("a"))
+
+	w := newWatcher(f, nil, testPrefix)
+	w.SetDebounce(0)
+	w.SetResyncInterval(100 * time.Millisecond)
+	w.Run()
+	defer w.Close()
+	waitFor(t, w.Subscribe(context.Background()), "a")
+
+	// 刚完成全量加载，重新加载的请求被忽略
+	for i := 0; i < 10; i++ {
+		w.Resync()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if gets, _ := f.revisions(); len(gets) != 1 {
+		t.Fatalf("get revisions = %v, want resync ignored within interval", gets)
+	}
+
+	// 超过最小间隔后重新全量加载
+	time.Sleep(60 * time.Millisecond)
+	w.Resync()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		gets, _ := f.revisions()
+		if len(gets) == 2 {
+			break
+		}
+		if len(gets) > 2 || time.Now().After(deadline) {
+			t.Fatalf("get revisions = %v, want one relist after interval", gets)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
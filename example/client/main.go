@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/zjmnssy/etcd"
@@ -15,7 +14,6 @@ import (
 	"github.com/zjmnssy/zlog"
 	"google.golang.org/grpc"
 	_ "google.golang.org/grpc/health"
-	"google.golang.org/grpc/resolver"
 )
 
 /***************************************** 获取grpc连接 **************************************************/
@@ -64,7 +62,7 @@ type ServerConfig struct {
 	HealthCheckConfig   HealthCheckConfig  `json:"healthCheckConfig"`
 }
 
-func getGRPCConn(serviceName string, scheme string) (*grpc.ClientConn, error) {
+func getGRPCConn(serviceName string, serviceType string) (*grpc.ClientConn, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(2)*time.Second)
 	defer cancel()
 
@@ -97,7 +95,7 @@ func getGRPCConn(serviceName string, scheme string) (*grpc.ClientConn, error) {
 	}
 
 	cc, err := grpc.DialContext(ctx,
-		fmt.Sprintf("%s:///", scheme),
+		fmt.Sprintf("%s:///%s", detector.Scheme, serviceType),
 		//grpc.WithBlock(), // 如果使用WithBlock()， 此接口返回失败，导致外面调用不好处理， 可能进入不了服务发现和负载均衡
 		grpc.WithInsecure(),
 		grpc.WithBackoffMaxDelay(time.Second),
@@ -114,49 +112,8 @@ func getGRPCConn(serviceName string, scheme string) (*grpc.ClientConn, error) {
 
 /***************************************** grpc client **************************************************/
 
-// GrpcService http service示例
-type GrpcService struct {
-	Addr       string `json:"address"`
-	Version    string `json:"version"`
-	Weight     string `json:"weight"`
-	ServerID   string `json:"serverID"`
-	ServerType string `json:"serverType"`
-}
-
-func extractAddr(key string, value string) (resolver.Address, string, error) {
-	var addr resolver.Address
-	var serverID string
-	var s GrpcService
-	metaData := make(map[string]string)
-
-	if value == "" {
-		strList := strings.Split(key, "/")
-		if len(strList) != 5 {
-			return addr, serverID, fmt.Errorf("key = %s error", key)
-		}
-		serverID = strList[4]
-	} else {
-		err := json.Unmarshal([]byte(value), &s)
-		if err != nil {
-			return addr, serverID, err
-		}
-	}
-
-	addr.Addr = s.Addr
-
-	metaData["version"] = s.Version
-	metaData["weight"] = s.Weight
-	metaData["serverID"] = s.ServerID
-	metaData["serverType"] = s.ServerType
-	addr.Metadata = &metaData
-
-	serverID = s.ServerID
-
-	return addr, serverID, nil
-}
-
 func exampleGRPC() {
-	cc, err := getGRPCConn("proto.Test", "grpc")
+	cc, err := getGRPCConn("proto.Test", "grpcTest")
 	if err != nil {
 		zlog.Prints(zlog.Warn, "main", "grpc dial: %s", err)
 		return
@@ -199,9 +156,8 @@ func main() {
 	c.DialKeepAlivePeriod = 5000
 	c.DialKeepAliveTimeout = 2000
 
-	// 依赖多个服务的情况下，每种服务集群注册一个对应的解析器，然后在构建客户端请求的时候，调用对应的scheme:///即可
-	detector.RegisterResolver("grpc", c, "/services/push/grpcTest", extractAddr)
-	//detector.RegisterResolver("http", c, "/services/push/httpTest", extractAddr)
+	// 注册一次解析器即可，依赖多个服务的情况下，构建客户端请求时使用对应的etcd:///serviceType即可
+	detector.RegisterBuilder(c, nil)
 
 	go exampleGRPC()
 
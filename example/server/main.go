@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"time"
 
 	"github.com/zjmnssy/etcd"
 	"github.com/zjmnssy/serviceRD/example/proto"
@@ -18,51 +18,33 @@ import (
 	"google.golang.org/grpc/peer"
 )
 
-/************************************************* service desc ***************************************************/
-
-// serviceDesc 服务描述
-type serviceDesc struct {
-	Addr       string `json:"address"`
-	Version    string `json:"version"`
-	Weight     string `json:"weight"`
-	ServerID   string `json:"serverID"`
-	ServerType string `json:"serverType"`
-}
-
-// GetServiceRegisterInfo 服务描述
-func (s *serviceDesc) GetServiceRegisterInfo() map[string]string {
-	var kvs = make(map[string]string)
-
-	bytes, err := json.Marshal(s)
-	if err != nil {
-		zlog.Prints(zlog.Warn, "main", "json marshal error = %s", err)
-	}
-
-	kvs[fmt.Sprintf("/services/push/%s/%s", s.ServerType, s.ServerID)] = string(bytes)
-
-	return kvs
-}
-
 /*************************************************** test server **************************************************/
 
 // RPCServer rpc服务
 type RPCServer struct {
-	info      serviceDesc
+	info      service.Instance
 	registrar *registrar.Registrar
 	s         *grpc.Server
 }
 
 // Run 启动
 func (s *RPCServer) Run() {
-	listener, err := net.Listen("tcp", s.info.Addr)
+	listener, err := net.Listen("tcp", s.info.Address)
 	if err != nil {
 		log.Printf("failed to listen: %v", err)
 		return
 	}
 
-	s.registrar.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
-	zlog.Prints(zlog.Info, "main", "rpc listening on:%s", s.info.Addr)
+	err = s.registrar.Start(ctx)
+	if err != nil {
+		zlog.Prints(zlog.Warn, "main", "registrar start error = %s", err)
+		return
+	}
+
+	zlog.Prints(zlog.Info, "main", "rpc listening on:%s", s.info.Address)
 
 	proto.RegisterTestServer(s.s, s)
 	s.s.Serve(listener)
@@ -70,6 +52,15 @@ func (s *RPCServer) Run() {
 
 // Stop 停止
 func (s *RPCServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 先标记为下线并等待客户端迁移，再停止grpc服务
+	err := s.registrar.Drain(ctx, 2*time.Second)
+	if err != nil {
+		zlog.Prints(zlog.Warn, "main", "registrar drain error = %s", err)
+	}
+
 	s.s.GracefulStop()
 }
 
@@ -80,7 +71,7 @@ func (s *RPCServer) Say(ctx context.Context, req *proto.SayReq) (*proto.SayResp,
 		zlog.Prints(zlog.Warn, "main", "GetClientIP error = %s", err)
 	}
 
-	text := "Hello " + addr + ", " + req.Content + ", I am " + s.info.ServerID
+	text := "Hello " + addr + ", " + req.Content + ", I am " + s.info.ID
 
 	zlog.Prints(zlog.Info, "main", "response : %s", text)
 
@@ -90,7 +81,7 @@ func (s *RPCServer) Say(ctx context.Context, req *proto.SayReq) (*proto.SayResp,
 /******************************************************** start ***************************************************/
 
 func getGrpcServer(c etcd.Config, desc service.Desc, serviceName string, ttl int64) (*grpc.Server, *registrar.Registrar, error) {
-	impl, err := registrar.NewRegistrar(c, desc, ttl)
+	impl, err := registrar.NewRegistrar(c, desc, registrar.WithTTL(ttl), registrar.WithHealthServices(serviceName))
 	if err != nil {
 		zlog.Prints(zlog.Warn, "example", "create new register error = %s", err)
 		return nil, nil, err
@@ -130,28 +121,32 @@ func startGRPC() {
 	c.DialKeepAlivePeriod = 5000
 	c.DialKeepAliveTimeout = 2000
 
-	serviceDesc := serviceDesc{
-		Addr:       "0.0.0.0:10001",
-		Version:    "20190828001",
-		Weight:     "1",
-		ServerID:   "node1",
-		ServerType: "grpcTest",
+	instance := service.Instance{
+		ID:      "node1",
+		Type:    "grpcTest",
+		Address: "0.0.0.0:10001",
+		Version: "20190828001",
+		Weight:  1,
 	}
 
-	s, impl, err := getGrpcServer(c, &serviceDesc, "proto.Test", 5)
+	s, impl, err := getGrpcServer(c, &instance, "proto.Test", 5)
 	if err != nil {
 		zlog.Prints(zlog.Warn, "example", "getGRPCServer error = %s", err)
 		return
 	}
 
-	server := &RPCServer{info: serviceDesc, registrar: impl, s: s}
+	server = &RPCServer{info: instance, registrar: impl, s: s}
 	go server.Run()
 }
 
 /**************************************************** main *************************************************/
 
-func quit() {
+var server *RPCServer
 
+func quit() {
+	if server != nil {
+		server.Stop()
+	}
 }
 
 func main() {
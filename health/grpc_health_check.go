@@ -41,3 +41,27 @@ func GetManager() *Manager {
 
 	return instanceManager
 }
+
+// SetServing 将指定服务的健康状态置为SERVING
+func (m *Manager) SetServing(serviceNames ...string) {
+	for _, name := range serviceNames {
+		m.DefaultHealthServer.SetServingStatus(name, grpc_health_v1.HealthCheckResponse_SERVING)
+	}
+}
+
+// SetNotServing 将指定服务的健康状态置为NOT_SERVING，其他服务不受影响
+func (m *Manager) SetNotServing(serviceNames ...string) {
+	for _, name := range serviceNames {
+		m.DefaultHealthServer.SetServingStatus(name, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	}
+}
+
+// Shutdown 将所有服务的健康状态置为NOT_SERVING，用于进程退出前通知客户端，之后的状态设置不再生效
+func (m *Manager) Shutdown() {
+	m.DefaultHealthServer.Shutdown()
+}
+
+// Resume 将所有服务的健康状态恢复为SERVING
+func (m *Manager) Resume() {
+	m.DefaultHealthServer.Resume()
+}
@@ -0,0 +1,25 @@
+// Package backoff 重试等待时间计算，供注册器、服务发现、配置监控共用
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Duration 第retries次重试前的等待时间，从base开始指数增长，不超过max，并在[d/2, d]之间随机
+func Duration(base time.Duration, max time.Duration, retries int) time.Duration {
+	d := base
+	for i := 0; i < retries && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,92 @@
+package registrar
+
+import (
+	"time"
+
+	"github.com/zjmnssy/zlog"
+	"go.etcd.io/etcd/clientv3"
+)
+
+const (
+	defaultEventBuffer = 100
+)
+
+// EventType 注册事件类型
+type EventType int
+
+const (
+	EventRegistered      EventType = iota // Start后首次注册成功
+	EventReregistered                     // 租约丢失后重新注册成功
+	EventRegisterFailed                   // 注册失败
+	EventLeaseLost                        // 租约过期或注册信息被删除
+	EventKeepAliveFailed                  // 保活中断
+	EventUnreachable                      // etcd不可达
+	EventDeregistered                     // Stop后注册信息已删除
+)
+
+var eventTypeNames = map[EventType]string{
+	EventRegistered:      "registered",
+	EventReregistered:    "re-registered",
+	EventRegisterFailed:  "register failed",
+	EventLeaseLost:       "lease lost",
+	EventKeepAliveFailed: "keepalive failed",
+	EventUnreachable:     "etcd unreachable",
+	EventDeregistered:    "deregistered",
+}
+
+func (t EventType) String() string {
+	name, ok := eventTypeNames[t]
+	if !ok {
+		return "unknown"
+	}
+
+	return name
+}
+
+// Event 注册事件
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	LeaseID clientv3.LeaseID
+	Err     error // 事件原因，成功类事件为nil
+}
+
+// EventHandler 注册事件回调，在产生事件的协程中同步调用，不要阻塞
+type EventHandler func(e Event)
+
+// Events 获取注册事件通道，消费不及时的事件会被丢弃
+func (r *Registrar) Events() <-chan Event {
+	return r.events
+}
+
+// OnEvent 增加注册事件回调
+func (r *Registrar) OnEvent(h EventHandler) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.handlers = append(r.handlers, h)
+}
+
+func (r *Registrar) emit(e Event) {
+	e.Time = time.Now()
+
+	if e.Err != nil {
+		zlog.Prints(zlog.Warn, "registrar", "event %s, lease = %x, error = %s", e.Type, e.LeaseID, e.Err)
+	} else {
+		zlog.Prints(zlog.Info, "registrar", "event %s, lease = %x", e.Type, e.LeaseID)
+	}
+
+	r.lock.Lock()
+	handlers := r.handlers
+	r.lock.Unlock()
+
+	for _, h := range handlers {
+		h(e)
+	}
+
+	select {
+	case r.events <- e:
+	default:
+		zlog.Prints(zlog.Debug, "registrar", "event channel full, drop event %s", e.Type)
+	}
+}
@@ -0,0 +1,103 @@
+package registrar
+
+import (
+	"time"
+
+	"github.com/zjmnssy/serviceRD/internal/backoff"
+	"github.com/zjmnssy/serviceRD/service"
+	"go.etcd.io/etcd/clientv3"
+)
+
+const (
+	defaultBackoffBase = 500  // per - Millisecond
+	defaultBackoffMax  = 3000 // per - Millisecond
+)
+
+// Option 注册器配置项
+type Option func(o *options)
+
+type options struct {
+	ttl             int64         // 租约时长，per - Second
+	timeout         time.Duration // 单次etcd操作超时
+	selfCheckPeriod time.Duration // 自检周期
+	backoffBase     time.Duration // 重新注册失败后的首次重试间隔
+	backoffMax      time.Duration // 重新注册失败后的最大重试间隔
+	layout          service.KeyLayout
+	client          *clientv3.Client
+	healthServices  []string // 由注册器控制健康状态的grpc服务名称
+}
+
+func defaultOptions() options {
+	return options{
+		ttl:             defaultLeaseTTL,
+		timeout:         time.Duration(defaultDialTimeout) * time.Millisecond,
+		selfCheckPeriod: time.Duration(defaultSelfCheckPeriod) * time.Second,
+		backoffBase:     time.Duration(defaultBackoffBase) * time.Millisecond,
+		backoffMax:      time.Duration(defaultBackoffMax) * time.Millisecond,
+		layout:          service.DefaultLayout,
+	}
+}
+
+// WithTTL 设置租约时长，单位秒
+func WithTTL(ttl int64) Option {
+	return func(o *options) {
+		if ttl > 0 {
+			o.ttl = ttl
+		}
+	}
+}
+
+// WithTimeout 设置单次etcd操作的超时时间
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.timeout = d
+		}
+	}
+}
+
+// WithSelfCheckPeriod 设置自检周期
+func WithSelfCheckPeriod(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.selfCheckPeriod = d
+		}
+	}
+}
+
+// WithBackoff 设置重新注册失败后的指数退避区间，实际间隔会加入随机抖动
+func WithBackoff(base time.Duration, max time.Duration) Option {
+	return func(o *options) {
+		if base > 0 && max >= base {
+			o.backoffBase = base
+			o.backoffMax = max
+		}
+	}
+}
+
+// WithKeyPrefix 设置etcd中服务信息的根目录，默认为/services，未指定Layout的service.Instance按此目录注册
+func WithKeyPrefix(prefix string) Option {
+	return func(o *options) {
+		o.layout = service.KeyLayout{Root: prefix}
+	}
+}
+
+// WithClient 使用已有的etcd连接，多个注册器可共用一个连接，注册器不负责关闭此连接
+func WithClient(c *clientv3.Client) Option {
+	return func(o *options) {
+		o.client = c
+	}
+}
+
+// WithHealthServices 设置由注册器控制健康状态的grpc服务名称，Drain时只将这些服务置为NOT_SERVING，
+// Start成功或Drain失败时恢复为SERVING，同一进程中其他服务的健康状态不受影响
+func WithHealthServices(names ...string) Option {
+	return func(o *options) {
+		o.healthServices = append(o.healthServices, names...)
+	}
+}
+
+// backoff 第retries次重试前的等待时间
+func (o *options) backoff(retries int) time.Duration {
+	return backoff.Duration(o.backoffBase, o.backoffMax, retries)
+}
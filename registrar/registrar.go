@@ -2,127 +2,456 @@ package registrar
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/zjmnssy/etcd"
+	"github.com/zjmnssy/serviceRD/config"
+	"github.com/zjmnssy/serviceRD/health"
 	"github.com/zjmnssy/serviceRD/service"
+	"github.com/zjmnssy/zlog"
 	"go.etcd.io/etcd/clientv3"
 )
 
+// 默认配置，可通过Option修改
 const (
 	defaultDialTimeout     = 1500 // per - Millisecond
 	defaultLeaseTTL        = 5    // per - Second
 	defaultSelfCheckPeriod = 3    // per - Second
 )
 
-// Registrar 注册器
+// etcdClient 注册器使用的etcd接口，由*clientv3.Client实现
+type etcdClient interface {
+	config.Client
+	Txn(ctx context.Context) clientv3.Txn
+	Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error)
+	Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error)
+	KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error)
+	TimeToLive(ctx context.Context, id clientv3.LeaseID, opts ...clientv3.LeaseOption) (*clientv3.LeaseTimeToLiveResponse, error)
+	Close() error
+}
+
+// Registrar 注册器，可同时注册多个服务，所有服务共用一个租约，所有方法均可并发调用
 type Registrar struct {
-	client      *clientv3.Client
-	serviceDesc service.Desc
-	ttl         int64
-	stopCheck   bool
-	leaseID     clientv3.LeaseID
-	cancel      context.CancelFunc
+	client    etcdClient
+	ownClient bool // 连接由注册器创建，Close时关闭
+	opts      options
+
+	lock     sync.Mutex
+	services map[string]*entry
+	running  bool
+	leaseID  clientv3.LeaseID
+	cancel   context.CancelFunc // 停止当前租约的保活
+	draining bool               // 下线过程中，注册记录的status为draining
+	stopCh   chan struct{}      // 通知自检协程退出
+	doneCh   chan struct{}      // 自检协程已退出
+	kickCh   chan struct{}      // 保活中断时通知自检协程立即检查
+
+	registered bool // Start后是否注册成功过，用于区分首次注册和重新注册
+	events     chan Event
+	handlers   []EventHandler
 }
 
-// NewRegistrar 创建注册实例
-func NewRegistrar(c etcd.Config, desc service.Desc, ttl int64) (*Registrar, error) {
+// NewRegistrar 创建注册实例，未通过WithClient指定连接时使用c创建新的etcd连接
+func NewRegistrar(c etcd.Config, desc service.Desc, opts ...Option) (*Registrar, error) {
+	return NewMultiRegistrar(c, []service.Desc{desc}, opts...)
+}
+
+// NewMultiRegistrar 创建同时注册多个服务的注册实例，启动后还可以通过Add、Remove增减服务
+func NewMultiRegistrar(c etcd.Config, descs []service.Desc, opts ...Option) (*Registrar, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	services, err := newEntries(descs, o.layout)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.client != nil {
+		return newRegistrar(o.client, false, services, o), nil
+	}
+
 	client, err := etcd.Client(c)
 	if err != nil {
 		return nil, err
 	}
 
+	return newRegistrar(client, true, services, o), nil
+}
+
+func newRegistrar(client etcdClient, ownClient bool, services map[string]*entry, o options) *Registrar {
 	r := Registrar{
-		client:      client,
-		serviceDesc: desc,
-		ttl:         ttl,
-		stopCheck:   false,
+		client:    client,
+		ownClient: ownClient,
+		opts:      o,
+		services:  services,
+		kickCh:    make(chan struct{}, 1),
+		events:    make(chan Event, defaultEventBuffer),
 	}
 
-	return &r, nil
+	return &r
 }
 
-// Start 启动自检协程，开始注册和保活
-func (r *Registrar) Start() {
-	go r.selfCheck()
+// Close 关闭注册器创建的etcd连接，需在Stop之后调用
+func (r *Registrar) Close() error {
+	if !r.ownClient {
+		return nil
+	}
+
+	return r.client.Close()
 }
 
-// Stop 停止服务注册和保活以及自检
-func (r *Registrar) Stop() {
-	r.stopCheck = true
+// Start 完成首次注册后启动自检协程，ctx只用于控制首次注册，不影响后续的保活和自检
+func (r *Registrar) Start(ctx context.Context) error {
+	r.lock.Lock()
+	if r.running {
+		r.lock.Unlock()
+		return fmt.Errorf("registrar already started")
+	}
+	r.running = true
+	stopCh, doneCh := make(chan struct{}), make(chan struct{})
+	r.stopCh, r.doneCh = stopCh, doneCh
+	r.lock.Unlock()
+
+	err := r.Register(ctx)
+	if err != nil {
+		r.lock.Lock()
+		if r.stopCh == stopCh {
+			r.running = false
+			r.stopCh, r.doneCh = nil, nil
+		}
+		r.lock.Unlock()
 
-	if r.cancel != nil {
-		r.cancel()
+		// 自检协程未启动，由此处通知Stop
+		close(doneCh)
+		return err
 	}
 
+	r.watchConfig()
+
+	// 重新启动时恢复Drain置为NOT_SERVING的健康状态
+	health.GetManager().SetServing(r.opts.healthServices...)
+
+	// 与Stop在同一把锁下判断，Stop之后不再启动自检协程
+	r.lock.Lock()
+	select {
+	case <-stopCh:
+		{
+			r.lock.Unlock()
+			close(doneCh)
+			return fmt.Errorf("registrar stopped while starting")
+		}
+	default:
+		{
+			go r.selfCheck(stopCh, doneCh)
+		}
+	}
+	r.lock.Unlock()
+
+	return nil
+}
+
+// Stop 停止自检和保活，删除注册信息并撤销租约，使实例立即不可被发现；
+// ctx结束时仍会在单独的超时时间内完成清理，之后返回ctx的错误
+func (r *Registrar) Stop(ctx context.Context) error {
+	r.lock.Lock()
+	if !r.running {
+		r.lock.Unlock()
+		return nil
+	}
+
+	r.running = false
+	stopCh, doneCh := r.stopCh, r.doneCh
+	r.stopCh, r.doneCh = nil, nil
+	if stopCh != nil {
+		close(stopCh)
+	}
+	r.lock.Unlock()
+
+	var ctxErr error
+	if doneCh != nil {
+		select {
+		case <-doneCh:
+		case <-ctx.Done():
+			ctxErr = ctx.Err()
+		}
+	}
+
+	r.closeConfig()
+
+	r.lock.Lock()
+	leaseID, cancel := r.leaseID, r.cancel
 	r.leaseID = clientv3.NoLease
 	r.cancel = nil
+	r.registered = false
+	r.lock.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+
+	if leaseID == clientv3.NoLease {
+		return ctxErr
+	}
+
+	// 调用方的ctx已结束时使用单独的超时时间，保证租约被撤销
+	ctxClean := ctx
+	if ctx.Err() != nil {
+		var cancelClean context.CancelFunc
+		ctxClean, cancelClean = context.WithTimeout(context.Background(), r.opts.timeout)
+		defer cancelClean()
+	}
+
+	err := r.deregister(ctxClean, leaseID)
+	r.emit(Event{Type: EventDeregistered, LeaseID: leaseID, Err: err})
+
+	if err != nil {
+		return err
+	}
+
+	return ctxErr
 }
 
-// Register 注册服务（非阻塞保活，异步）
-func (r *Registrar) Register() error {
-	var err error
+// deregister 删除注册信息并撤销租约，删除失败时仍撤销租约，注册信息随租约删除
+func (r *Registrar) deregister(ctx context.Context, leaseID clientv3.LeaseID) error {
+	err := r.deleteKeys(ctx, r.entries())
+	if err != nil {
+		zlog.Prints(zlog.Warn, "registrar", "delete register info error = %s", err)
+	}
+
+	_, errRevoke := r.client.Revoke(ctx, leaseID)
+	if errRevoke != nil {
+		return errRevoke
+	}
 
-	if r.leaseID != clientv3.NoLease {
-		r.Stop()
+	return err
+}
+
+// Register 使用新租约重新注册服务（非阻塞保活，异步），成功后撤销旧租约，只能在Start之后调用
+func (r *Registrar) Register(ctx context.Context) error {
+	err := r.register(ctx)
+	if err != nil {
+		r.emit(Event{Type: EventRegisterFailed, Err: err})
 	}
 
-	r.stopCheck = false
+	return err
+}
 
-	ctxTemp, cancel := context.WithTimeout(context.Background(), time.Duration(defaultDialTimeout)*time.Millisecond)
+func (r *Registrar) register(ctx context.Context) error {
+	ctxTemp, cancel := context.WithTimeout(ctx, r.opts.timeout)
 	defer cancel()
 
-	if r.ttl <= 0 {
-		r.ttl = defaultLeaseTTL
+	resp, err := r.client.Grant(ctxTemp, r.opts.ttl)
+	if err != nil {
+		return err
 	}
+	leaseID := resp.ID
 
-	_, r.leaseID, err = etcd.CreateLease(ctxTemp, r.client, r.ttl)
+	err = r.put(ctxTemp, r.registerInfo(), leaseID)
 	if err != nil {
+		r.revoke(leaseID)
 		return err
 	}
 
-	_, err = etcd.TxnPutWithLease(ctxTemp, r.client, r.serviceDesc.GetServiceRegisterInfo(), r.leaseID)
+	ctxKeep, cancelKeep := context.WithCancel(context.Background())
+
+	keepCh, err := r.client.KeepAlive(ctxKeep, leaseID)
 	if err != nil {
+		cancelKeep()
+		r.revoke(leaseID)
 		return err
 	}
 
-	ctxKeep, cancel := context.WithCancel(context.Background())
-	if r.cancel != nil {
-		r.cancel()
+	go r.keepAlive(ctxKeep, leaseID, keepCh)
+
+	r.lock.Lock()
+	if !r.running {
+		r.lock.Unlock()
+		cancelKeep()
+		r.revoke(leaseID)
+		return fmt.Errorf("registrar not running")
 	}
-	r.cancel = cancel
 
-	_, err = etcd.KeepAliveAways(ctxKeep, r.client, r.leaseID)
-	if err != nil {
-		return err
+	oldLeaseID, oldCancel := r.leaseID, r.cancel
+	r.leaseID, r.cancel = leaseID, cancelKeep
+	eventType := EventRegistered
+	if r.registered {
+		eventType = EventReregistered
 	}
+	r.registered = true
+	r.lock.Unlock()
+
+	if oldCancel != nil {
+		oldCancel()
+	}
+
+	if oldLeaseID != clientv3.NoLease {
+		r.revoke(oldLeaseID)
+	}
+
+	r.emit(Event{Type: eventType, LeaseID: leaseID})
 
 	return nil
 }
 
+// keepAlive 消费保活应答，保活非主动停止而中断时通知自检协程立即检查
+func (r *Registrar) keepAlive(ctx context.Context, leaseID clientv3.LeaseID, ch <-chan *clientv3.LeaseKeepAliveResponse) {
+	for range ch {
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	r.emit(Event{Type: EventKeepAliveFailed, LeaseID: leaseID, Err: fmt.Errorf("keepalive channel closed")})
+
+	select {
+	case r.kickCh <- struct{}{}:
+	default:
+	}
+}
+
 // IsHealth 检查注册是否健康
 func (r *Registrar) IsHealth() bool {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(defaultDialTimeout)*time.Millisecond)
+	alive, _, _ := r.checkLease()
+
+	return alive
+}
+
+// checkLease 检查当前租约是否存活，err不为nil表示etcd不可达
+func (r *Registrar) checkLease() (bool, clientv3.LeaseID, error) {
+	r.lock.Lock()
+	leaseID := r.leaseID
+	empty := len(r.services) == 0
+	r.lock.Unlock()
+
+	if leaseID == clientv3.NoLease {
+		return false, leaseID, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.timeout)
 	defer cancel()
 
-	_, keys, err := etcd.LeaseTimeToLive(ctx, r.client, r.leaseID)
+	resp, err := r.client.TimeToLive(ctx, leaseID, clientv3.WithAttachedKeys())
 	if err != nil {
-		return false
+		return false, leaseID, err
 	}
 
-	if len(keys) == 0 {
-		return false
+	// 租约已过期
+	if resp.TTL <= 0 {
+		return false, leaseID, nil
 	}
 
-	return true
+	// 没有服务时租约下本来就没有注册信息
+	if len(resp.Keys) == 0 && !empty {
+		return false, leaseID, nil
+	}
+
+	return true, leaseID, nil
 }
 
-func (r *Registrar) selfCheck() {
+// revoke 撤销租约，租约下的注册信息随之删除
+func (r *Registrar) revoke(leaseID clientv3.LeaseID) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.timeout)
+	defer cancel()
+
+	_, err := r.client.Revoke(ctx, leaseID)
+	if err != nil {
+		zlog.Prints(zlog.Warn, "registrar", "revoke lease %x error = %s", leaseID, err)
+	}
+}
+
+// Drain 优雅下线：先在注册记录中标记为draining并将WithHealthServices指定的服务的健康检查置为NOT_SERVING，
+// 等待wait时间让客户端迁移走后，再删除注册信息并撤销租约，下线失败时恢复健康状态
+func (r *Registrar) Drain(ctx context.Context, wait time.Duration) error {
+	r.lock.Lock()
+	if !r.running {
+		r.lock.Unlock()
+		return fmt.Errorf("registrar not running")
+	}
+	r.draining = true
+	leaseID := r.leaseID
+	r.lock.Unlock()
+
+	if leaseID != clientv3.NoLease {
+		ctxTemp, cancel := context.WithTimeout(ctx, r.opts.timeout)
+		err := r.put(ctxTemp, r.registerInfo(), leaseID)
+		cancel()
+		if err != nil {
+			zlog.Prints(zlog.Warn, "registrar", "put draining register info error = %s", err)
+		}
+	}
+
+	health.GetManager().SetNotServing(r.opts.healthServices...)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	// ctx可能已在等待期间结束，使用单独的超时时间（等待自检协程退出和删除注册信息各一次）下线，
+	// 避免实例一直以draining状态保持注册
+	ctxStop, cancel := context.WithTimeout(context.Background(), 2*r.opts.timeout)
+	defer cancel()
+
+	err := r.Stop(ctxStop)
+
+	r.lock.Lock()
+	r.draining = false
+	r.lock.Unlock()
+
+	if err != nil {
+		health.GetManager().SetServing(r.opts.healthServices...)
+	}
+
+	return err
+}
+
+func (r *Registrar) selfCheck(stopCh chan struct{}, doneCh chan struct{}) {
+	defer close(doneCh)
+
+	retries := 0
+	timer := time.NewTimer(r.opts.selfCheckPeriod)
+	defer timer.Stop()
+
 	for {
-		if !r.IsHealth() && !r.stopCheck {
-			r.Register()
+		select {
+		case <-stopCh:
+			return
+		case <-timer.C:
+		case <-r.kickCh:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+
+		next := r.opts.selfCheckPeriod
+
+		r.watchConfig()
+
+		alive, leaseID, err := r.checkLease()
+		if !alive {
+			if err != nil {
+				r.emit(Event{Type: EventUnreachable, LeaseID: leaseID, Err: err})
+			} else if leaseID != clientv3.NoLease {
+				r.emit(Event{Type: EventLeaseLost, LeaseID: leaseID})
+			}
+
+			err = r.Register(context.Background())
+			if err != nil {
+				next = r.opts.backoff(retries)
+				retries++
+			} else {
+				retries = 0
+			}
 		}
 
-		time.Sleep(time.Duration(defaultSelfCheckPeriod) * time.Second)
+		timer.Reset(next)
 	}
 }
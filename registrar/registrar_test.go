@@ -0,0 +1,401 @@
+package registrar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zjmnssy/serviceRD/service"
+	"go.etcd.io/etcd/clientv3"
+	pb "go.etcd.io/etcd/etcdserver/etcdserverpb"
+)
+
+// fakeEtcd 内存中的etcd，clientv3.Op不提供租约，写入的key属于最近创建且未撤销的租约，没有租约时写入失败
+type fakeEtcd struct {
+	lock    sync.Mutex
+	nextID  clientv3.LeaseID
+	leases  map[clientv3.LeaseID]chan *clientv3.LeaseKeepAliveResponse // 租约及其保活通道
+	kvs     map[string]fakeKV
+	deleted []string           // 通过事务删除的key
+	revoked []clientv3.LeaseID // 撤销的租约
+	checks  int                // TimeToLive调用次数
+}
+
+type fakeKV struct {
+	value string
+	lease clientv3.LeaseID
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		leases: make(map[clientv3.LeaseID]chan *clientv3.LeaseKeepAliveResponse),
+		kvs:    make(map[string]fakeKV),
+	}
+}
+
+func (f *fakeEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return &clientv3.GetResponse{Header: &pb.ResponseHeader{Revision: 1}}, nil
+}
+
+func (f *fakeEtcd) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+
+	return ch
+}
+
+func (f *fakeEtcd) Txn(ctx context.Context) clientv3.Txn {
+	return &fakeTxn{f: f}
+}
+
+func (f *fakeEtcd) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.nextID++
+	f.leases[f.nextID] = make(chan *clientv3.LeaseKeepAliveResponse)
+
+	return &clientv3.LeaseGrantResponse{ID: f.nextID, TTL: ttl}, nil
+}
+
+func (f *fakeEtcd) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	ch, ok := f.leases[id]
+	if !ok {
+		return nil, fmt.Errorf("requested lease not found")
+	}
+
+	delete(f.leases, id)
+	close(ch)
+	f.revoked = append(f.revoked, id)
+
+	for k, kv := range f.kvs {
+		if kv.lease == id {
+			delete(f.kvs, k)
+		}
+	}
+
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+// KeepAlive 保活通道在租约撤销时关闭，ctx结束后不再关心
+func (f *fakeEtcd) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	ch, ok := f.leases[id]
+	if !ok {
+		return nil, fmt.Errorf("requested lease not found")
+	}
+
+	return ch, nil
+}
+
+func (f *fakeEtcd) TimeToLive(ctx context.Context, id clientv3.LeaseID, opts ...clientv3.LeaseOption) (*clientv3.LeaseTimeToLiveResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.checks++
+
+	if _, ok := f.leases[id]; !ok {
+		return &clientv3.LeaseTimeToLiveResponse{ID: id, TTL: -1}, nil
+	}
+
+	resp := &clientv3.LeaseTimeToLiveResponse{ID: id, TTL: defaultLeaseTTL}
+	for k, kv := range f.kvs {
+		if kv.lease == id {
+			resp.Keys = append(resp.Keys, []byte(k))
+		}
+	}
+
+	return resp, nil
+}
+
+func (f *fakeEtcd) Close() error {
+	return nil
+}
+
+// commit 在一个事务中执行写入和删除
+func (f *fakeEtcd) commit(ops []clientv3.Op) (*clientv3.TxnResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	owner := clientv3.NoLease
+	for id := range f.leases {
+		if id > owner {
+			owner = id
+		}
+	}
+
+	for _, op := range ops {
+		if op.IsPut() && owner == clientv3.NoLease {
+			return nil, fmt.Errorf("requested lease not found")
+		}
+	}
+
+	for _, op := range ops {
+		key := string(op.KeyBytes())
+		switch {
+		case op.IsPut():
+			{
+				f.kvs[key] = fakeKV{value: string(op.ValueBytes()), lease: owner}
+			}
+		case op.IsDelete():
+			{
+				delete(f.kvs, key)
+				f.deleted = append(f.deleted, key)
+			}
+		}
+	}
+
+	return &clientv3.TxnResponse{Succeeded: true}, nil
+}
+
+// state 当前的key、存活的租约数、撤销的租约和删除的key
+func (f *fakeEtcd) state() (keys []string, leases int, revoked []clientv3.LeaseID, deleted []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for k := range f.kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys, len(f.leases), append([]clientv3.LeaseID(nil), f.revoked...), append([]string(nil), f.deleted...)
+}
+
+func (f *fakeEtcd) value(key string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.kvs[key].value
+}
+
+func (f *fakeEtcd) checkCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.checks
+}
+
+type fakeTxn struct {
+	f   *fakeEtcd
+	ops []clientv3.Op
+}
+
+func (t *fakeTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	return t
+}
+
+func (t *fakeTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.ops = append(t.ops, ops...)
+	return t
+}
+
+func (t *fakeTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	return t
+}
+
+func (t *fakeTxn) Commit() (*clientv3.TxnResponse, error) {
+	return t.f.commit(t.ops)
+}
+
+func testDesc(id string) *service.Instance {
+	return &service.Instance{Type: "test", ID: id, Address: id + ":8080", Version: "20190828001", Weight: 1}
+}
+
+// testRegistrar 自检周期为5ms
+func testRegistrar(t *testing.T, f *fakeEtcd, descs ...service.Desc) *Registrar {
+	t.Helper()
+
+	o := defaultOptions()
+	o.selfCheckPeriod = 5 * time.Millisecond
+
+	services, err := newEntries(descs, o.layout)
+	if err != nil {
+		t.Fatalf("new entries error = %s", err)
+	}
+
+	return newRegistrar(f, false, services, o)
+}
+
+func pushKeys(descs ...*service.Instance) []string {
+	keys := make([]string, 0)
+	for _, desc := range descs {
+		for k := range normalize(desc, service.DefaultLayout).GetServiceRegisterInfo() {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func equalKeys(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestStopRevokesLeaseAndDeletesKeys(t *testing.T) {
+	f := newFakeEtcd()
+	a, b := testDesc("a"), testDesc("b")
+	r := testRegistrar(t, f, a, b)
+
+	err := r.Start(context.Background())
+	if err != nil {
+		t.Fatalf("start error = %s", err)
+	}
+
+	keys, leases, _, _ := f.state()
+	if !equalKeys(keys, pushKeys(a, b)) || leases != 1 {
+		t.Fatalf("keys = %v, leases = %d after start, want %v under one lease", keys, leases, pushKeys(a, b))
+	}
+
+	r.lock.Lock()
+	leaseID := r.leaseID
+	r.lock.Unlock()
+
+	err = r.Stop(context.Background())
+	if err != nil {
+		t.Fatalf("stop error = %s", err)
+	}
+
+	keys, leases, revoked, deleted := f.state()
+	if len(keys) != 0 || leases != 0 {
+		t.Fatalf("keys = %v, leases = %d after stop, want none", keys, leases)
+	}
+	if len(revoked) != 1 || revoked[0] != leaseID {
+		t.Fatalf("revoked = %v, want %x", revoked, leaseID)
+	}
+
+	// 注册信息由删除事务删除，不依赖租约撤销
+	sort.Strings(deleted)
+	if !equalKeys(deleted, pushKeys(a, b)) {
+		t.Fatalf("deleted = %v, want %v", deleted, pushKeys(a, b))
+	}
+}
+
+func TestSelfCheckExitsOnStop(t *testing.T) {
+	f := newFakeEtcd()
+	r := testRegistrar(t, f, testDesc("a"))
+
+	err := r.Start(context.Background())
+	if err != nil {
+		t.Fatalf("start error = %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for f.checkCount() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("self check did not run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	err = r.Stop(context.Background())
+	if err != nil {
+		t.Fatalf("stop error = %s", err)
+	}
+
+	// Stop返回时自检协程已退出，之后不再检查租约
+	n := f.checkCount()
+	time.Sleep(50 * time.Millisecond)
+	if f.checkCount() != n {
+		t.Fatalf("lease checked %d times after stop", f.checkCount()-n)
+	}
+}
+
+func TestConcurrentLifecycle(t *testing.T) {
+	f := newFakeEtcd()
+	r := testRegistrar(t, f, testDesc("a"))
+
+	var wg sync.WaitGroup
+	run := func(n int, fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				fn(i)
+			}
+		}()
+	}
+
+	run(20, func(i int) {
+		_ = r.Start(context.Background())
+	})
+	run(20, func(i int) {
+		_ = r.Stop(context.Background())
+	})
+	run(10, func(i int) {
+		_ = r.Drain(context.Background(), 0)
+	})
+	run(20, func(i int) {
+		desc := testDesc(fmt.Sprintf("b%d", i%3))
+		_ = r.Add(context.Background(), desc)
+		_ = r.Remove(context.Background(), desc)
+	})
+	run(20, func(i int) {
+		r.IsHealth()
+	})
+	wg.Wait()
+
+	err := r.Stop(context.Background())
+	if err != nil {
+		t.Fatalf("stop error = %s", err)
+	}
+
+	keys, leases, _, _ := f.state()
+	if len(keys) != 0 || leases != 0 {
+		t.Fatalf("keys = %v, leases = %d after stop, want none", keys, leases)
+	}
+}
+
+func TestRegisteredAtStampedOnce(t *testing.T) {
+	f := newFakeEtcd()
+	a := testDesc("a")
+	r := testRegistrar(t, f, a)
+
+	err := r.Start(context.Background())
+	if err != nil {
+		t.Fatalf("start error = %s", err)
+	}
+	defer r.Stop(context.Background())
+
+	key := pushKeys(a)[0]
+	first := f.value(key)
+
+	// 重新注册时注册记录不变
+	time.Sleep(10 * time.Millisecond)
+	err = r.Register(context.Background())
+	if err != nil {
+		t.Fatalf("register error = %s", err)
+	}
+
+	if f.value(key) != first {
+		t.Fatalf("record = %s after re-register, want %s", f.value(key), first)
+	}
+
+	var instance service.Instance
+	err = json.Unmarshal([]byte(first), &instance)
+	if err != nil || instance.RegisteredAt.IsZero() {
+		t.Fatalf("record = %s, error = %v, want registeredAt set", first, err)
+	}
+}
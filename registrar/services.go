@@ -0,0 +1,363 @@
+package registrar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zjmnssy/serviceRD/config"
+	"github.com/zjmnssy/serviceRD/service"
+	"github.com/zjmnssy/zlog"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// entry 注册器中的一个服务，所有服务共用注册器的租约
+type entry struct {
+	id       string
+	desc     service.Desc
+	config   *config.Watcher
+	noConfig bool // 注册信息中没有/services/push下的路径，无需监控配置
+	weight   int  // 来自/services/pull/serviceType/serviceID/weight的权重，config.NoWeight表示使用服务描述中的权重
+}
+
+func newEntry(id string, desc service.Desc) *entry {
+	return &entry{id: id, desc: desc, weight: config.NoWeight}
+}
+
+// newEntries 创建注册器的初始服务，key为服务标识
+func newEntries(descs []service.Desc, layout service.KeyLayout) (map[string]*entry, error) {
+	services := make(map[string]*entry)
+	for _, desc := range descs {
+		desc = normalize(desc, layout)
+
+		id := descID(desc)
+		if id == "" {
+			return nil, fmt.Errorf("service desc has no register info")
+		}
+
+		if _, ok := services[id]; ok {
+			return nil, fmt.Errorf("service %s duplicated", id)
+		}
+
+		services[id] = newEntry(id, desc)
+	}
+
+	return services, nil
+}
+
+// normalize service.Instance未指定目录布局时使用注册器的目录布局，注册、删除及监控配置均使用布局后的路径；
+// 未指定注册时间时使用添加服务的时间，之后重新注册或更新权重时保持不变
+func normalize(desc service.Desc, layout service.KeyLayout) service.Desc {
+	instance, ok := desc.(*service.Instance)
+	if !ok || (instance.Layout != (service.KeyLayout{}) && !instance.RegisteredAt.IsZero()) {
+		return desc
+	}
+
+	patched := *instance
+	if patched.Layout == (service.KeyLayout{}) {
+		patched.Layout = layout
+	}
+	if patched.RegisteredAt.IsZero() {
+		patched.RegisteredAt = time.Now()
+	}
+
+	return &patched
+}
+
+// descID 服务标识，由服务的注册路径组成
+func descID(desc service.Desc) string {
+	keys := make([]string, 0)
+	for k := range desc.GetServiceRegisterInfo() {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return strings.Join(keys, ",")
+}
+
+// Add 增加服务，注册器已启动时在当前租约下立即注册，不影响其他服务
+func (r *Registrar) Add(ctx context.Context, desc service.Desc) error {
+	desc = normalize(desc, r.opts.layout)
+	id := descID(desc)
+	if id == "" {
+		return fmt.Errorf("service desc has no register info")
+	}
+
+	e := newEntry(id, desc)
+
+	r.lock.Lock()
+	if _, ok := r.services[id]; ok {
+		r.lock.Unlock()
+		return fmt.Errorf("service %s already added", id)
+	}
+	r.services[id] = e
+	running, leaseID := r.running, r.leaseID
+	r.lock.Unlock()
+
+	if !running || leaseID == clientv3.NoLease {
+		return nil
+	}
+
+	// 写入期间租约可能被重新注册替换，此时需要在新租约下再写一次
+	for {
+		ctxTemp, cancel := context.WithTimeout(ctx, r.opts.timeout)
+		err := r.put(ctxTemp, r.entryInfo(e), leaseID)
+		cancel()
+		if err != nil {
+			r.lock.Lock()
+			delete(r.services, id)
+			r.lock.Unlock()
+			return err
+		}
+
+		r.lock.Lock()
+		current := r.leaseID
+		r.lock.Unlock()
+
+		if current == leaseID || current == clientv3.NoLease {
+			break
+		}
+
+		leaseID = current
+	}
+
+	r.watchConfig()
+
+	return nil
+}
+
+// Remove 移除服务并立即删除其注册信息，不影响其他服务
+func (r *Registrar) Remove(ctx context.Context, desc service.Desc) error {
+	desc = normalize(desc, r.opts.layout)
+	id := descID(desc)
+
+	r.lock.Lock()
+	e, ok := r.services[id]
+	if !ok {
+		r.lock.Unlock()
+		return fmt.Errorf("service %s not found", id)
+	}
+	delete(r.services, id)
+	w := e.config
+	e.config = nil
+	leaseID := r.leaseID
+	r.lock.Unlock()
+
+	if w != nil {
+		w.Close()
+	}
+
+	if leaseID == clientv3.NoLease {
+		return nil
+	}
+
+	return r.deleteKeys(ctx, []*entry{e})
+}
+
+// entries 获取当前所有服务
+func (r *Registrar) entries() []*entry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	list := make([]*entry, 0, len(r.services))
+	for _, e := range r.services {
+		list = append(list, e)
+	}
+
+	return list
+}
+
+// deleteKeys 在一个事务中删除服务的注册信息
+func (r *Registrar) deleteKeys(ctx context.Context, list []*entry) error {
+	ops := make([]clientv3.Op, 0)
+	for _, e := range list {
+		for k := range e.desc.GetServiceRegisterInfo() {
+			ops = append(ops, clientv3.OpDelete(k))
+		}
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	_, err := r.client.Txn(ctx).Then(ops...).Commit()
+
+	return err
+}
+
+// put 在一个事务中使用租约写入注册信息
+func (r *Registrar) put(ctx context.Context, kvs map[string]string, leaseID clientv3.LeaseID) error {
+	ops := make([]clientv3.Op, 0, len(kvs))
+	for k, v := range kvs {
+		ops = append(ops, clientv3.OpPut(k, v, clientv3.WithLease(leaseID)))
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	_, err := r.client.Txn(ctx).Then(ops...).Commit()
+
+	return err
+}
+
+// registerInfo 获取所有服务的注册信息
+func (r *Registrar) registerInfo() map[string]string {
+	kvs := make(map[string]string)
+
+	for _, e := range r.entries() {
+		for k, v := range r.entryInfo(e) {
+			kvs[k] = v
+		}
+	}
+
+	return kvs
+}
+
+// entryInfo 获取服务的注册信息，配置了权重（包括0）或处于下线过程中时替换注册记录中的weight、status字段，
+// service.Instance直接修改对应字段，其他服务描述按JSON格式修改
+func (r *Registrar) entryInfo(e *entry) map[string]string {
+	r.lock.Lock()
+	weight, draining := e.weight, r.draining
+	r.lock.Unlock()
+
+	if instance, ok := e.desc.(*service.Instance); ok {
+		patched := *instance
+		if weight != config.NoWeight {
+			patched.Weight = weight
+		}
+		if draining {
+			patched.Status = service.StatusDraining
+		}
+
+		return patched.GetServiceRegisterInfo()
+	}
+
+	kvs := e.desc.GetServiceRegisterInfo()
+
+	patch := make(map[string]string)
+	if weight != config.NoWeight {
+		patch["weight"] = strconv.Itoa(weight)
+	}
+	if draining {
+		patch["status"] = service.StatusDraining
+	}
+
+	if len(patch) == 0 {
+		return kvs
+	}
+
+	for k, v := range kvs {
+		if _, _, ok := r.opts.layout.ParsePushKey(k); !ok {
+			continue
+		}
+
+		record := make(map[string]interface{})
+		err := json.Unmarshal([]byte(v), &record)
+		if err != nil {
+			zlog.Prints(zlog.Warn, "registrar", "push record key = %s is not json, error = %s", k, err)
+			continue
+		}
+
+		for field, value := range patch {
+			record[field] = value
+		}
+
+		bytes, err := json.Marshal(record)
+		if err != nil {
+			zlog.Prints(zlog.Warn, "registrar", "json marshal error = %s", err)
+			continue
+		}
+
+		kvs[k] = string(bytes)
+	}
+
+	return kvs
+}
+
+// updateWeight 权重变化后，在现有租约下重新写入此服务的注册记录
+func (r *Registrar) updateWeight(e *entry, old int, new int) {
+	r.lock.Lock()
+	e.weight = new
+	leaseID := r.leaseID
+	_, ok := r.services[e.id]
+	r.lock.Unlock()
+
+	zlog.Prints(zlog.Info, "registrar", "service %s weight changed from %d to %d", e.id, old, new)
+
+	if !ok || leaseID == clientv3.NoLease {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.timeout)
+	defer cancel()
+
+	err := r.put(ctx, r.entryInfo(e), leaseID)
+	if err != nil {
+		zlog.Prints(zlog.Warn, "registrar", "put register info with new weight error = %s", err)
+	}
+}
+
+// watchConfig 监控各服务的权重配置，失败时由自检协程重试
+func (r *Registrar) watchConfig() {
+	for _, e := range r.entries() {
+		r.lock.Lock()
+		skip := e.config != nil || e.noConfig
+		r.lock.Unlock()
+
+		if skip {
+			continue
+		}
+
+		e := e
+		handler := config.Handler{OnWeight: func(old int, new int) { r.updateWeight(e, old, new) }}
+
+		w, err := config.NewWatcherWithLayout(r.client, r.opts.layout, e.desc, handler)
+		if err != nil {
+			zlog.Prints(zlog.Debug, "registrar", "service %s has no config, error = %s", e.id, err)
+			r.lock.Lock()
+			e.noConfig = true
+			r.lock.Unlock()
+			continue
+		}
+
+		err = w.Run()
+		if err != nil {
+			zlog.Prints(zlog.Warn, "registrar", "run config watcher error = %s", err)
+			continue
+		}
+
+		r.lock.Lock()
+		_, ok := r.services[e.id]
+		if !r.running || !ok || e.config != nil {
+			r.lock.Unlock()
+			w.Close()
+			continue
+		}
+		e.config = w
+		r.lock.Unlock()
+	}
+}
+
+// closeConfig 停止监控所有服务的配置
+func (r *Registrar) closeConfig() {
+	watchers := make([]*config.Watcher, 0)
+
+	r.lock.Lock()
+	for _, e := range r.services {
+		if e.config != nil {
+			watchers = append(watchers, e.config)
+			e.config = nil
+		}
+	}
+	r.lock.Unlock()
+
+	for _, w := range watchers {
+		w.Close()
+	}
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Instance 标准服务实例描述，对应/services/push/serviceType/serviceID下的注册记录，实现了Desc接口
+type Instance struct {
+	ID           string            `json:"serverID"`
+	Type         string            `json:"serverType"`
+	Address      string            `json:"address"`
+	Version      string            `json:"version"`            // 年月日＋三位序号，如20190828001
+	Weight       int               `json:"weight,string"`      // 与README中的格式保持一致，以字符串存储，0表示不分配流量
+	Region       string            `json:"region,omitempty"`   // 地域
+	Zone         string            `json:"zone,omitempty"`     // 可用区
+	Tags         []string          `json:"tags,omitempty"`     // 标签
+	Metadata     map[string]string `json:"metadata,omitempty"` // 自定义信息
+	Status       string            `json:"status,omitempty"`   // StatusUp、StatusDraining，为空视为StatusUp
+	RegisteredAt time.Time         `json:"registeredAt"`       // 注册时间，为零时由注册器在添加服务时设置
+	Layout       KeyLayout         `json:"-"`                  // etcd目录布局，零值为DefaultLayout
+}
+
+// Key 实例的注册路径
+func (i *Instance) Key() string {
+	return i.Layout.PushKey(i.Type, i.ID)
+}
+
+// IsDraining 实例是否处于下线过程中
+func (i *Instance) IsDraining() bool {
+	return i.Status == StatusDraining
+}
+
+// Encode 编码为注册记录
+func (i *Instance) Encode() (string, error) {
+	bytes, err := json.Marshal(i)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
+// GetServiceRegisterInfo 服务描述
+func (i *Instance) GetServiceRegisterInfo() map[string]string {
+	kvs := make(map[string]string)
+
+	value, err := i.Encode()
+	if err != nil {
+		return kvs
+	}
+
+	kvs[i.Key()] = value
+
+	return kvs
+}
+
+// UnmarshalJSON 兼容weight以数字存储的注册记录，没有weight字段时使用DefaultWeight
+func (i *Instance) UnmarshalJSON(data []byte) error {
+	type alias Instance
+
+	aux := struct {
+		*alias
+		Weight interface{} `json:"weight"`
+	}{alias: (*alias)(i)}
+
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+
+	switch w := aux.Weight.(type) {
+	case nil:
+		i.Weight = DefaultWeight
+	case float64:
+		i.Weight = int(w)
+	case string:
+		if w == "" {
+			i.Weight = DefaultWeight
+			break
+		}
+
+		n, err := strconv.Atoi(w)
+		if err != nil {
+			return fmt.Errorf("invalid weight %q", w)
+		}
+		i.Weight = n
+	default:
+		return fmt.Errorf("invalid weight %v", w)
+	}
+
+	return nil
+}
+
+// DecodeInstance 解析注册记录
+func DecodeInstance(value string) (Instance, error) {
+	var i Instance
+
+	err := json.Unmarshal([]byte(value), &i)
+	if err != nil {
+		return i, err
+	}
+
+	return i, nil
+}
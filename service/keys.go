@@ -0,0 +1,71 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultRoot 服务信息在etcd中的默认根目录
+const DefaultRoot = "/services"
+
+const (
+	pullDir   = "pull"
+	pushDir   = "push"
+	commonDir = "common"
+)
+
+// KeyLayout etcd中服务信息的目录布局，详见README
+type KeyLayout struct {
+	Root string // 根目录，为空时使用DefaultRoot
+}
+
+// DefaultLayout 默认目录布局
+var DefaultLayout = KeyLayout{Root: DefaultRoot}
+
+func (l KeyLayout) root() string {
+	if l.Root == "" {
+		return DefaultRoot
+	}
+
+	return strings.TrimRight(l.Root, "/")
+}
+
+// PushPrefix 某类服务注册目录前缀：/services/push/serviceType/
+func (l KeyLayout) PushPrefix(serviceType string) string {
+	return fmt.Sprintf("%s/%s/%s/", l.root(), pushDir, serviceType)
+}
+
+// PushKey 服务实例注册路径：/services/push/serviceType/serviceID
+func (l KeyLayout) PushKey(serviceType string, serviceID string) string {
+	return l.PushPrefix(serviceType) + serviceID
+}
+
+// PullPrefix 某类服务配置目录前缀：/services/pull/serviceType/
+func (l KeyLayout) PullPrefix(serviceType string) string {
+	return fmt.Sprintf("%s/%s/%s/", l.root(), pullDir, serviceType)
+}
+
+// PullCommonPrefix 某类服务共用配置目录前缀：/services/pull/serviceType/common/
+func (l KeyLayout) PullCommonPrefix(serviceType string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/", l.root(), pullDir, serviceType, commonDir)
+}
+
+// PullInstancePrefix 服务实例配置目录前缀：/services/pull/serviceType/serviceID/
+func (l KeyLayout) PullInstancePrefix(serviceType string, serviceID string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/", l.root(), pullDir, serviceType, serviceID)
+}
+
+// ParsePushKey 从服务注册路径中解析出服务类型和服务ID
+func (l KeyLayout) ParsePushKey(key string) (serviceType string, serviceID string, ok bool) {
+	prefix := fmt.Sprintf("%s/%s/", l.root(), pushDir)
+	if !strings.HasPrefix(key, prefix) {
+		return "", "", false
+	}
+
+	strList := strings.Split(strings.TrimPrefix(key, prefix), "/")
+	if len(strList) != 2 || strList[0] == "" || strList[1] == "" {
+		return "", "", false
+	}
+
+	return strList[0], strList[1], true
+}
@@ -1,5 +1,23 @@
 package service
 
+// 注册记录中status字段的取值，缺省视为StatusUp
+const (
+	StatusUp       = "up"       // 正常提供服务
+	StatusDraining = "draining" // 下线过程中，客户端不再选择此实例
+)
+
+// DefaultWeight 注册记录中没有weight字段时使用的权重，weight为0表示实例不分配流量
+const DefaultWeight = 1
+
+// AttributeKey 服务发现时实例信息在resolver.Address.Attributes中的key
+type AttributeKey string
+
+// 实例所在位置在resolver.Address.Attributes中的key，值为string
+const (
+	AttrRegion AttributeKey = "region"
+	AttrZone   AttributeKey = "zone"
+)
+
 // Desc 服务描述接口
 type Desc interface {
 	GetServiceRegisterInfo() map[string]string // 获取服务描述自己的信息，用于注册使用